@@ -0,0 +1,215 @@
+package main
+
+// Bisecting failed branch builds which cover several changes to find the one which broke the build.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+const (
+	BisectRunning = "running"
+	BisectDone    = "done"
+	BisectAborted = "aborted"
+)
+
+type Bisection struct {
+	ID       int64
+	Project  string
+	Ref      string
+	Pipeline string
+	OldRev   string
+	NewRev   string
+	// Candidate changes, oldest first.  The newest is the failed branch build.
+	Revisions []MergedChange
+	// Index of the newest candidate known to pass, -1 for OldRev, and of the oldest known to fail.
+	Good  int
+	Bad   int
+	State string
+	// Revision of the culprit once found.
+	Culprit string
+}
+
+// Returns the next candidate to build, or false once the culprit is bad.
+func nextCandidate(good int, bad int) (int, bool) {
+	if bad-good <= 1 {
+		return bad, false
+	}
+	return (good + bad) / 2, true
+}
+
+func (s *State) AddBisection(bisection Bisection) Bisection {
+	revisions, err := json.Marshal(bisection.Revisions)
+	if err != nil {
+		log.Fatalf("json encode failed: %s", err)
+	}
+	result, err := s.DB.Exec("insert into bisections (project, ref, pipeline, oldrev, newrev, revisions, good, bad, state) values (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		bisection.Project, bisection.Ref, bisection.Pipeline, bisection.OldRev, bisection.NewRev, string(revisions), bisection.Good, bisection.Bad, bisection.State)
+	if err != nil {
+		log.Fatalf("Failed to exec: %s", err)
+	}
+	bisection.ID, _ = result.LastInsertId()
+	return bisection
+}
+
+func (s *State) GetBisection(id int64) (Bisection, bool) {
+	var bisection Bisection
+	var revisions string
+	err := s.DB.QueryRow("select id, project, ref, pipeline, oldrev, newrev, revisions, good, bad, state, coalesce(culprit, '') from bisections where id = ?", id).Scan(
+		&bisection.ID, &bisection.Project, &bisection.Ref, &bisection.Pipeline, &bisection.OldRev, &bisection.NewRev, &revisions,
+		&bisection.Good, &bisection.Bad, &bisection.State, &bisection.Culprit)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Fatalf("Failed to query: '%v'", err)
+		}
+		return bisection, false
+	}
+	if err := json.Unmarshal([]byte(revisions), &bisection.Revisions); err != nil {
+		log.Fatalf("json decode failed: %s", err)
+	}
+	return bisection, true
+}
+
+// Records the progress of a bisection.
+func (s *State) UpdateBisection(bisection Bisection) {
+	if _, err := s.DB.Exec("update bisections set good = ?, bad = ?, state = ?, culprit = ? where id = ?",
+		bisection.Good, bisection.Bad, bisection.State, bisection.Culprit, bisection.ID); err != nil {
+		log.Fatalf("Failed to exec: %s", err)
+	}
+}
+
+func (s *State) AddBisectBuild(id string, bisection int64, candidate int) {
+	if _, err := s.DB.Exec("insert into bisect_builds (id, bisection, candidate) values (?, ?, ?)", id, bisection, candidate); err != nil {
+		log.Fatalf("Failed to exec: %s", err)
+	}
+}
+
+// Returns the bisection and candidate a build belongs to.
+func (s *State) GetBisectBuild(id string) (int64, int, bool) {
+	var bisection int64
+	var candidate int
+	err := s.DB.QueryRow("select bisection, candidate from bisect_builds where id = ?", id).Scan(&bisection, &candidate)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Fatalf("Failed to query: '%v'", err)
+		}
+		return 0, 0, false
+	}
+	return bisection, candidate, true
+}
+
+// Starts bisecting a failed branch build, if the project wants it and there is more than one change to blame.
+// changes are the changes merged in the build, newest first.
+func (s *State) startBisection(branchBuild BranchBuild, build Build, changes []MergedChange) {
+	if !s.projectConfig(branchBuild.Project).Bisect || len(changes) < 2 {
+		return
+	}
+	// Only bisect if we found every commit in the range, otherwise the oldest one can't be assumed to have a passing parent.
+	if changes[len(changes)-1].Parent != branchBuild.OldRev {
+		log.Printf("Couldn't resolve every commit between %s and %s, not bisecting", branchBuild.OldRev, branchBuild.NewRev)
+		return
+	}
+
+	revisions := slices.Clone(changes)
+	slices.Reverse(revisions)
+
+	s.mu.Lock()
+	bisection := s.AddBisection(Bisection{
+		Project:   branchBuild.Project,
+		Ref:       branchBuild.Ref,
+		Pipeline:  branchBuild.Pipeline,
+		OldRev:    branchBuild.OldRev,
+		NewRev:    branchBuild.NewRev,
+		Revisions: revisions,
+		Good:      -1,
+		Bad:       len(revisions) - 1,
+		State:     BisectRunning,
+	})
+	s.mu.Unlock()
+
+	log.Printf("Bisecting %d changes in %s between %s and %s", len(revisions), branchBuild.Ref, branchBuild.OldRev, branchBuild.NewRev)
+	s.advanceBisection(bisection)
+}
+
+// Builds the next candidate of a bisection, or reports the culprit once it has been found.
+func (s *State) advanceBisection(bisection Bisection) {
+	candidate, ok := nextCandidate(bisection.Good, bisection.Bad)
+	if !ok {
+		s.reportCulprit(bisection)
+		return
+	}
+
+	change := bisection.Revisions[candidate]
+	name, _, _ := parseRefName(bisection.Ref)
+	s.createBuild(s.Buildkite, bisection.Pipeline, &buildkite.CreateBuild{
+		Commit:  change.Revision,
+		Branch:  name,
+		Message: fmt.Sprintf("Bisecting %s: %d %s", name, change.Number, change.Subject),
+		Env: map[string]string{
+			"GERRIT_BISECT":  "true",
+			"GERRIT_PROJECT": bisection.Project,
+			"GERRIT_REF":     bisection.Ref,
+		},
+	}, func(build *buildkite.Build) {
+		s.AddBisectBuild(*build.ID, bisection.ID, candidate)
+		log.Printf("Scheduled bisect build %s of %s for change %d", *build.ID, change.Revision, change.Number)
+	})
+}
+
+// Handles a finished build if it was started by a bisection.  Returns false if it wasn't.
+func (s *State) handleBisectBuildFinished(build Build) bool {
+	s.mu.Lock()
+	id, candidate, ok := s.GetBisectBuild(build.ID)
+	if !ok {
+		s.mu.Unlock()
+		return false
+	}
+	bisection, ok := s.GetBisection(id)
+	if !ok || bisection.State != BisectRunning || candidate <= bisection.Good || candidate >= bisection.Bad {
+		s.mu.Unlock()
+		log.Printf("Ignoring stale bisect build %s", build.ID)
+		return true
+	}
+
+	switch build.State {
+	case "passed":
+		bisection.Good = candidate
+	case "failed":
+		bisection.Bad = candidate
+	default:
+		bisection.State = BisectAborted
+	}
+	s.UpdateBisection(bisection)
+	s.mu.Unlock()
+
+	if bisection.State == BisectAborted {
+		log.Printf("Bisect build %s was %s, giving up on bisecting %s", build.ID, build.State, bisection.Ref)
+		return true
+	}
+	s.advanceBisection(bisection)
+	return true
+}
+
+// Posts the culprit of a bisection on its change.
+func (s *State) reportCulprit(bisection Bisection) {
+	culprit := bisection.Revisions[bisection.Bad]
+	bisection.Culprit = culprit.Revision
+	bisection.State = BisectDone
+	s.mu.Lock()
+	s.UpdateBisection(bisection)
+	s.mu.Unlock()
+
+	name, _, _ := parseRefName(bisection.Ref)
+	log.Printf("Bisection of %s identified %d (%s) as the culprit", bisection.Ref, culprit.Number, culprit.Revision)
+	s.review(culprit.Number, culprit.Patchset, Review{
+		Message: fmt.Sprintf("Bisecting the failed post-merge build of %s identified this change as the one which broke it.", name),
+	})
+	s.notify(bisection.Project, fmt.Sprintf("Bisecting the failed post-merge build of %s %s identified %d %s as the culprit: %s",
+		bisection.Project, name, culprit.Number, culprit.Subject, culprit.URL))
+	s.proposeRevert(bisection.Project, culprit, fmt.Sprintf("Bisecting the failed post-merge build of %s identified this change as the one which broke it.", name))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBisectionFindsCulprit(t *testing.T) {
+	for n := 2; n <= 9; n++ {
+		for culprit := 0; culprit < n; culprit++ {
+			good, bad := -1, n-1
+			builds := 0
+			for {
+				candidate, ok := nextCandidate(good, bad)
+				if !ok {
+					if candidate != culprit {
+						t.Fatalf("expected culprit %d of %d but got %d", culprit, n, candidate)
+					}
+					break
+				}
+				if candidate <= good || candidate >= bad {
+					t.Fatalf("candidate %d outside of (%d, %d)", candidate, good, bad)
+				}
+				builds++
+				if candidate >= culprit {
+					bad = candidate
+				} else {
+					good = candidate
+				}
+			}
+			// The failed branch build already covers the newest change.
+			if maxBuilds := bitsNeeded(n); builds > maxBuilds {
+				t.Fatalf("expected at most %d builds to bisect %d changes but took %d", maxBuilds, n, builds)
+			}
+		}
+	}
+}
+
+// Returns ceil(log2(n)).
+func bitsNeeded(n int) int {
+	bits := 0
+	for (1 << bits) < n {
+		bits++
+	}
+	return bits
+}
+
+func TestBisectionDatabase(t *testing.T) {
+	state := setupTestState(t)
+
+	bisection := state.AddBisection(Bisection{
+		Project:   "p",
+		Ref:       "refs/heads/main",
+		Pipeline:  "ci",
+		OldRev:    "a",
+		NewRev:    "d",
+		Revisions: []MergedChange{{Number: 1, Revision: "b", Parent: "a"}, {Number: 2, Revision: "c", Parent: "b"}, {Number: 3, Revision: "d", Parent: "c"}},
+		Good:      -1,
+		Bad:       2,
+		State:     BisectRunning,
+	})
+	state.AddBisectBuild("build-1", bisection.ID, 1)
+
+	id, candidate, ok := state.GetBisectBuild("build-1")
+	if !ok || id != bisection.ID || candidate != 1 {
+		t.Fatalf("unexpected bisect build %d %d %v", id, candidate, ok)
+	}
+
+	bisection.Bad = 1
+	bisection.State = BisectDone
+	bisection.Culprit = "c"
+	state.UpdateBisection(bisection)
+
+	stored, ok := state.GetBisection(bisection.ID)
+	if !ok || !reflect.DeepEqual(stored, bisection) {
+		t.Fatalf("expected %#v but got %#v", bisection, stored)
+	}
+}
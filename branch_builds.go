@@ -0,0 +1,183 @@
+package main
+
+// Building branches and tags after they are updated, typically by changes being merged.
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+// Gerrit reports deleted refs with an all zero new revision.
+const zeroRevision = "0000000000000000000000000000000000000000"
+
+// Default refs built when a project doesn't configure any.
+var defaultBranchBuilds = []BranchBuildConfig{
+	{Ref: "refs/heads/master"},
+	{Ref: "refs/heads/main"},
+}
+
+type BranchBuild struct {
+	Project  string
+	Ref      string
+	OldRev   string
+	NewRev   string
+	Pipeline string
+	Number   int
+	State    string
+	WebURL   string
+}
+
+// Returns the full name of a ref.  Older gerrit versions report branches without the refs/heads/ prefix.
+func fullRefName(refName string) string {
+	if strings.HasPrefix(refName, "refs/") {
+		return refName
+	}
+	return "refs/heads/" + refName
+}
+
+// Splits a full ref name into the branch or tag name, and whether it is a tag.
+// Eg; "refs/heads/release/1.2" is branch "release/1.2", and "refs/tags/v1.0" is tag "v1.0".
+func parseRefName(refName string) (name string, tag bool, ok bool) {
+	if name, ok := strings.CutPrefix(refName, "refs/heads/"); ok && name != "" {
+		return name, false, true
+	}
+	if name, ok := strings.CutPrefix(refName, "refs/tags/"); ok && name != "" {
+		return name, true, true
+	}
+	return "", false, false
+}
+
+// Returns the pipelines a ref should be built in.
+func (s *State) branchBuildPipelines(project string, refName string) []string {
+	rules := s.projectConfig(project).BranchBuilds
+	if rules == nil {
+		rules = defaultBranchBuilds
+	}
+
+	var result []string
+	for _, rule := range rules {
+		if matched, _ := path.Match(rule.Ref, refName); !matched {
+			continue
+		}
+		pipeline := rule.Pipeline
+		if pipeline == "" {
+			pipeline = s.BuildkiteProject
+		}
+		result = append(result, pipeline)
+	}
+	return result
+}
+
+// Records a branch build.
+func (s *State) AddBranchBuild(id string, build BranchBuild) {
+	if _, err := s.DB.Exec("insert into branch_builds (id, project, ref, oldrev, newrev, pipeline, number) values (?, ?, ?, ?, ?, ?, ?)",
+		id, build.Project, build.Ref, build.OldRev, build.NewRev, build.Pipeline, build.Number); err != nil {
+		log.Fatalf("Failed to exec: %s", err)
+	}
+}
+
+// Reads a branch build from the database.
+func (s *State) GetBranchBuild(id string) (BranchBuild, bool) {
+	var build BranchBuild
+	err := s.DB.QueryRow("select project, ref, oldrev, newrev, pipeline, number, coalesce(state, ''), coalesce(weburl, '') from branch_builds where id = ?", id).Scan(
+		&build.Project, &build.Ref, &build.OldRev, &build.NewRev, &build.Pipeline, &build.Number, &build.State, &build.WebURL)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Fatalf("Failed to query: '%v'", err)
+		}
+		return build, false
+	}
+	return build, true
+}
+
+// Records the final state of a branch build.
+func (s *State) SetBranchBuildResult(id string, state string, webURL string) {
+	if _, err := s.DB.Exec("update branch_builds set state = ?, weburl = ? where id = ?", state, webURL, id); err != nil {
+		log.Printf("Failed to record result of %s: %v", id, err)
+	}
+}
+
+// Handles a ref-updated event, building the ref in every pipeline it is configured for.
+func (s *State) handleRefUpdated(eventInfo EventInfo, client *buildkite.Client) {
+	refUpdate := eventInfo.RefUpdate
+	if refUpdate == nil || !s.watchesProject(refUpdate.Project) {
+		return
+	}
+	if refUpdate.NewRev == zeroRevision {
+		log.Printf("Ignoring deletion of %s", refUpdate.RefName)
+		return
+	}
+
+	refName := fullRefName(refUpdate.RefName)
+	name, tag, ok := parseRefName(refName)
+	if !ok {
+		return
+	}
+
+	for _, pipeline := range s.branchBuildPipelines(refUpdate.Project, refName) {
+		env := map[string]string{
+			"GERRIT_PROJECT": refUpdate.Project,
+			"GERRIT_REF":     refName,
+			"GERRIT_OLDREV":  refUpdate.OldRev,
+			"GERRIT_NEWREV":  refUpdate.NewRev,
+		}
+		if tag {
+			env["GERRIT_TAG"] = name
+		} else {
+			env["GERRIT_BRANCH"] = name
+		}
+
+		s.createBuild(client, pipeline, &buildkite.CreateBuild{
+			Commit: refUpdate.NewRev,
+			Branch: name,
+			Author: buildkite.Author{
+				Name:  eventInfo.Submitter.Name,
+				Email: eventInfo.Submitter.Email,
+			},
+			Env: env,
+		}, func(build *buildkite.Build) {
+			branchBuild := BranchBuild{
+				Project:  refUpdate.Project,
+				Ref:      refName,
+				OldRev:   refUpdate.OldRev,
+				NewRev:   refUpdate.NewRev,
+				Pipeline: pipeline,
+			}
+			if build.Number != nil {
+				branchBuild.Number = *build.Number
+			}
+			s.AddBranchBuild(*build.ID, branchBuild)
+			log.Printf("Scheduled %s build %s in %s\n", name, *build.ID, pipeline)
+		})
+	}
+}
+
+// Handles a finished build if it is a branch build.  Returns false if it wasn't one.
+func (s *State) handleBranchBuildFinished(build Build) bool {
+	s.mu.Lock()
+	branchBuild, ok := s.GetBranchBuild(build.ID)
+	if ok {
+		s.SetBranchBuildResult(build.ID, build.State, build.WebURL)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	log.Printf("Branch build %s of %s at %s: %s", build.ID, branchBuild.Ref, branchBuild.NewRev, build.State)
+	if build.State == "failed" {
+		changes := s.mergedChanges(branchBuild.Project, branchBuild.OldRev, branchBuild.NewRev)
+		s.reportBranchFailure(branchBuild, build, changes)
+		if len(changes) == 1 && changes[0].Parent == branchBuild.OldRev {
+			name, _, _ := parseRefName(branchBuild.Ref)
+			s.proposeRevert(branchBuild.Project, changes[0], fmt.Sprintf("This change was the only one in the failed post-merge build of %s: %s", name, build.WebURL))
+		}
+		s.startBisection(branchBuild, build, changes)
+	}
+	return true
+}
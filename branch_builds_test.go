@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRefName(t *testing.T) {
+	type testCase struct {
+		input string
+		name  string
+		tag   bool
+		ok    bool
+	}
+
+	testCases := []testCase{
+		{input: "refs/heads/main", name: "main", ok: true},
+		{input: "refs/heads/release/1.2", name: "release/1.2", ok: true},
+		{input: "refs/tags/v1.0", name: "v1.0", tag: true, ok: true},
+		{input: "refs/changes/34/1234/2", ok: false},
+		{input: "refs/meta/config", ok: false},
+		{input: "refs/heads/", ok: false},
+		// Older gerrit versions report bare branch names
+		{input: fullRefName("master"), name: "master", ok: true},
+	}
+
+	for id, tc := range testCases {
+		name, tag, ok := parseRefName(tc.input)
+		if name != tc.name || tag != tc.tag || ok != tc.ok {
+			t.Errorf("expected %q %v %v for case %d but got %q %v %v", tc.name, tc.tag, tc.ok, id, name, tag, ok)
+		}
+	}
+}
+
+func TestBranchBuildPipelines(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `{"projects": {"configured": {"branch_builds": [
+		{"ref": "refs/heads/main"},
+		{"ref": "refs/heads/main", "pipeline": "docs"},
+		{"ref": "refs/heads/release/*", "pipeline": "release"},
+		{"ref": "refs/tags/v*", "pipeline": "release"}
+	]}}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	state := &State{Config: config, BuildkiteProject: "ci"}
+
+	type testCase struct {
+		project   string
+		ref       string
+		pipelines []string
+	}
+
+	testCases := []testCase{
+		{project: "configured", ref: "refs/heads/main", pipelines: []string{"ci", "docs"}},
+		{project: "configured", ref: "refs/heads/release/1.2", pipelines: []string{"release"}},
+		{project: "configured", ref: "refs/heads/release/1.2/hotfix", pipelines: nil},
+		{project: "configured", ref: "refs/tags/v1.0", pipelines: []string{"release"}},
+		{project: "configured", ref: "refs/heads/master", pipelines: nil},
+		// Unconfigured projects keep building master and main
+		{project: "other", ref: "refs/heads/master", pipelines: []string{"ci"}},
+		{project: "other", ref: "refs/heads/main", pipelines: []string{"ci"}},
+		{project: "other", ref: "refs/heads/feature", pipelines: nil},
+	}
+
+	for id, tc := range testCases {
+		if pipelines := state.branchBuildPipelines(tc.project, tc.ref); !reflect.DeepEqual(pipelines, tc.pipelines) {
+			t.Errorf("expected %v for case %d but got %v", tc.pipelines, id, pipelines)
+		}
+	}
+
+	if _, err := LoadConfig(writeConfig(t, `{"projects": {"p": {"branch_builds": [{"ref": "main"}]}}}`)); err == nil {
+		t.Fatalf("expected a short ref name to be rejected")
+	}
+	if _, err := LoadConfig(writeConfig(t, `{"projects": {"p": {"branch_builds": [{"ref": "refs/heads/[main"}]}}}`)); err == nil {
+		t.Fatalf("expected a bad pattern to be rejected")
+	}
+}
+
+func TestWalkMergedChanges(t *testing.T) {
+	// main moved from a to d through changes 1, 2 and 3.  x was pushed directly.
+	commits := map[string]struct {
+		change  int
+		parents []string
+	}{
+		"b": {change: 1, parents: []string{"a"}},
+		"c": {change: 2, parents: []string{"b"}},
+		"d": {change: 3, parents: []string{"c", "z"}},
+		"y": {change: 4, parents: []string{"x"}},
+	}
+	lookup := func(revision string) (MergedChange, []string, bool) {
+		commit, ok := commits[revision]
+		if !ok {
+			return MergedChange{}, nil, false
+		}
+		return MergedChange{Number: commit.change, Revision: revision}, commit.parents, true
+	}
+	numbers := func(changes []MergedChange) []int {
+		result := []int{}
+		for _, change := range changes {
+			result = append(result, change.Number)
+		}
+		return result
+	}
+
+	type testCase struct {
+		oldRev  string
+		newRev  string
+		limit   int
+		changes []int
+	}
+
+	testCases := []testCase{
+		{oldRev: "a", newRev: "d", limit: 100, changes: []int{3, 2, 1}},
+		{oldRev: "c", newRev: "d", limit: 100, changes: []int{3}},
+		{oldRev: "a", newRev: "d", limit: 2, changes: []int{3, 2}},
+		// Stops at commits which didn't come from a change
+		{oldRev: "w", newRev: "y", limit: 100, changes: []int{4}},
+		// New branches only report their tip
+		{oldRev: zeroRevision, newRev: "d", limit: 100, changes: []int{3}},
+		{oldRev: "d", newRev: "d", limit: 100, changes: []int{}},
+	}
+
+	for id, tc := range testCases {
+		if changes := numbers(walkMergedChanges(tc.oldRev, tc.newRev, tc.limit, lookup)); !reflect.DeepEqual(changes, tc.changes) {
+			t.Errorf("expected %v for case %d but got %v", tc.changes, id, changes)
+		}
+	}
+}
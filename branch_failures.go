@@ -0,0 +1,128 @@
+package main
+
+// Reporting failed branch builds back to the changes which landed in them.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Maximum number of commits walked back from a branch build looking for the changes it covers.
+const maxBranchBuildCommits = 100
+
+// A change merged into a branch.
+type MergedChange struct {
+	Number   int
+	Patchset int
+	ChangeId string
+	Subject  string
+	URL      string
+	// Commit the change landed as, and its first parent.
+	Revision string
+	Parent   string
+}
+
+// Returns the changes merged between oldRev and newRev, newest first, by walking first parents back from newRev.
+// lookup returns the change and patchset a commit belongs to.  The walk stops early at commits which didn't come from a change.
+func walkMergedChanges(oldRev string, newRev string, limit int, lookup func(revision string) (MergedChange, []string, bool)) []MergedChange {
+	var result []MergedChange
+	revision := newRev
+	for i := 0; i < limit && revision != oldRev && revision != "" && revision != zeroRevision; i++ {
+		change, parents, ok := lookup(revision)
+		if !ok {
+			log.Printf("Commit %s isn't from a change, stopping", revision)
+			break
+		}
+		if len(parents) > 0 {
+			change.Parent = parents[0]
+		}
+		result = append(result, change)
+		// A brand new branch has no old revision, so only look at its tip.
+		if oldRev == zeroRevision || len(parents) == 0 {
+			break
+		}
+		revision = parents[0]
+	}
+	return result
+}
+
+// Returns the changes merged into a project between two revisions.
+func (s *State) mergedChanges(project string, oldRev string, newRev string) []MergedChange {
+	return walkMergedChanges(oldRev, newRev, maxBranchBuildCommits, func(revision string) (MergedChange, []string, bool) {
+		changes, err := s.query(fmt.Sprintf("project:%s commit:%s", project, revision), "--patch-sets")
+		if err != nil {
+			log.Printf("Failed to look up commit %s: %v", revision, err)
+			return MergedChange{}, nil, false
+		}
+		for _, change := range changes {
+			for _, patchSet := range change.PatchSets {
+				if patchSet.Revision != revision {
+					continue
+				}
+				return MergedChange{
+					Number:   change.Number,
+					Patchset: patchSet.Number,
+					ChangeId: change.ID,
+					Subject:  change.Subject,
+					URL:      change.URL,
+					Revision: revision,
+				}, patchSet.Parents, true
+			}
+		}
+		return MergedChange{}, nil, false
+	})
+}
+
+// Posts a failed branch build on every change which landed in it, and notifies the project's channel.
+func (s *State) reportBranchFailure(branchBuild BranchBuild, build Build, changes []MergedChange) {
+	name, _, _ := parseRefName(branchBuild.Ref)
+	log.Printf("Branch build %s of %s failed, reporting to %d changes", build.ID, branchBuild.Ref, len(changes))
+
+	for _, change := range changes {
+		message := fmt.Sprintf("Post-merge build of %s failed after this change merged: %s", name, build.WebURL)
+		if len(changes) > 1 {
+			message = fmt.Sprintf("Post-merge build of %s failed after this change merged along with %d others: %s", name, len(changes)-1, build.WebURL)
+		}
+		s.review(change.Number, change.Patchset, Review{Message: message})
+	}
+
+	lines := []string{fmt.Sprintf("Post-merge build of %s %s failed: %s", branchBuild.Project, name, build.WebURL)}
+	for _, change := range changes {
+		lines = append(lines, fmt.Sprintf("  %d %s %s", change.Number, change.Subject, change.URL))
+	}
+	s.notify(branchBuild.Project, strings.Join(lines, "\n"))
+}
+
+// Notifies the project's chat webhook, if it has one.
+func (s *State) notify(project string, text string) {
+	webhook := s.projectConfig(project).BranchFailureWebhook
+	if webhook == "" {
+		return
+	}
+	if err := postNotification(webhook, text); err != nil {
+		log.Printf("Failed to notify %s: %v", webhook, err)
+	}
+}
+
+// Posts a message to a chat webhook which accepts {"text": ...}, like Slack's incoming webhooks.
+func postNotification(url string, text string) error {
+	data, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+// The gerrit context passed to builds as environment and meta-data.
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+)
+
+// Data available to the branch and message templates.
+type BuildTemplateData struct {
+	Change   *Change
+	PatchSet *PatchSet
+}
+
+// Example data used to check templates when the config is loaded.
+var exampleBuildTemplateData = BuildTemplateData{
+	Change: &Change{
+		Project:       "project",
+		Branch:        "main",
+		ID:            "I0123456789abcdef0123456789abcdef01234567",
+		Number:        1234,
+		Subject:       "Add a feature",
+		Owner:         User{Name: "Owner", Email: "owner@example.com", Username: "owner"},
+		URL:           "https://gerrit.example.com/c/project/+/1234",
+		CommitMessage: "Add a feature\n\nChange-Id: I0123456789abcdef0123456789abcdef01234567\n",
+		Topic:         "topic",
+		Hashtags:      []string{"hashtag"},
+	},
+	PatchSet: &PatchSet{
+		Number:   2,
+		Revision: "0123456789abcdef0123456789abcdef01234567",
+		Ref:      "refs/changes/34/1234/2",
+		Uploader: User{Name: "Uploader", Email: "uploader@example.com", Username: "uploader"},
+		Kind:     "REWORK",
+	},
+}
+
+// Parses a template and checks it renders with example data.
+func parseBuildTemplate(name string, text string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := renderBuildTemplate(t, exampleBuildTemplateData); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func renderBuildTemplate(t *template.Template, data BuildTemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Returns the environment describing a patchset to its build.
+func gerritBuildEnv(change *Change, patchSet *PatchSet) map[string]string {
+	return map[string]string{
+		"GERRIT_PROJECT":                 change.Project,
+		"GERRIT_BRANCH":                  change.Branch,
+		"GERRIT_CHANGE_ID":               change.ID,
+		"GERRIT_CHANGE_NUMBER":           fmt.Sprintf("%d", change.Number),
+		"GERRIT_CHANGE_URL":              change.URL,
+		"GERRIT_CHANGE_SUBJECT":          change.Subject,
+		"GERRIT_CHANGE_COMMIT_MESSAGE":   change.CommitMessage,
+		"GERRIT_CHANGE_OWNER_NAME":       change.Owner.Name,
+		"GERRIT_CHANGE_OWNER_EMAIL":      change.Owner.Email,
+		"GERRIT_TOPIC":                   change.Topic,
+		"GERRIT_HASHTAGS":                strings.Join(change.Hashtags, ","),
+		"GERRIT_PATCH_NUMBER":            fmt.Sprintf("%d", patchSet.Number),
+		"GERRIT_PATCHSET_REVISION":       patchSet.Revision,
+		"GERRIT_PATCHSET_KIND":           patchSet.Kind,
+		"GERRIT_PATCHSET_UPLOADER_NAME":  patchSet.Uploader.Name,
+		"GERRIT_PATCHSET_UPLOADER_EMAIL": patchSet.Uploader.Email,
+		"GERRIT_REFSPEC":                 patchSet.Ref,
+	}
+}
+
+// Returns build meta-data holding the same values as env, with keys like "gerrit-change-number".
+// Buildkite doesn't accept empty meta-data values, so those are left out.
+func gerritMetaData(env map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range env {
+		if v == "" {
+			continue
+		}
+		result[metaDataKey(k)] = v
+	}
+	return result
+}
+
+// Returns the meta-data key for a gerrit environment variable, eg; gerrit-change-number for GERRIT_CHANGE_NUMBER.
+func metaDataKey(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+}
+
+// Returns the Buildkite branch and message for a build of the patchset, from the project's templates.
+func (s *State) buildBranchAndMessage(change *Change, patchSet *PatchSet) (string, string) {
+	config := s.projectConfig(change.Project)
+	data := BuildTemplateData{Change: change, PatchSet: patchSet}
+
+	branch := change.ID
+	if config.branchTemplate != nil {
+		rendered, err := renderBuildTemplate(config.branchTemplate, data)
+		if err != nil {
+			log.Printf("Failed to render branch_template for %d: %v", change.Number, err)
+		} else if rendered != "" {
+			branch = rendered
+		}
+	}
+
+	message := ""
+	if config.messageTemplate != nil {
+		rendered, err := renderBuildTemplate(config.messageTemplate, data)
+		if err != nil {
+			log.Printf("Failed to render message_template for %d: %v", change.Number, err)
+		} else {
+			message = rendered
+		}
+	}
+	return branch, message
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGerritBuildEnv(t *testing.T) {
+	env := gerritBuildEnv(exampleBuildTemplateData.Change, exampleBuildTemplateData.PatchSet)
+
+	expected := map[string]string{
+		"GERRIT_PROJECT":       "project",
+		"GERRIT_BRANCH":        "main",
+		"GERRIT_CHANGE_NUMBER": "1234",
+		"GERRIT_PATCH_NUMBER":  "2",
+		"GERRIT_REFSPEC":       "refs/changes/34/1234/2",
+		"GERRIT_HASHTAGS":      "hashtag",
+		"GERRIT_PATCHSET_KIND": "REWORK",
+	}
+	for k, v := range expected {
+		if env[k] != v {
+			t.Errorf("expected %s=%q but got %q", k, v, env[k])
+		}
+	}
+
+	metaData := gerritMetaData(map[string]string{"GERRIT_CHANGE_NUMBER": "1234", "GERRIT_TOPIC": ""})
+	if len(metaData) != 1 || metaData["gerrit-change-number"] != "1234" {
+		t.Fatalf("unexpected meta-data %v", metaData)
+	}
+}
+
+func TestBuildTemplates(t *testing.T) {
+	type testCase struct {
+		config      string
+		expectation bool
+		branch      string
+		message     string
+	}
+
+	testCases := []testCase{
+		// Defaults
+		{
+			config:      `{}`,
+			expectation: true,
+			branch:      exampleBuildTemplateData.Change.ID,
+			message:     "",
+		},
+		{
+			config:      `{"branch_template": "gerrit/{{.Change.Branch}}/{{.Change.Number}}", "message_template": "{{.Change.Subject}} ({{.PatchSet.Number}})"}`,
+			expectation: true,
+			branch:      "gerrit/main/1234",
+			message:     "Add a feature (2)",
+		},
+		// Syntax errors
+		{
+			config:      `{"branch_template": "{{.Change.Number"}`,
+			expectation: false,
+		},
+		// Missing fields are caught at load time
+		{
+			config:      `{"message_template": "{{.Change.Title}}"}`,
+			expectation: false,
+		},
+	}
+
+	for id, tc := range testCases {
+		config, err := LoadConfig(writeConfig(t, `{"projects": {"project": `+tc.config+`}}`))
+		if (err == nil) != tc.expectation {
+			t.Fatalf("expected success %v for case %d but got %v", tc.expectation, id, err)
+		}
+		if !tc.expectation {
+			continue
+		}
+		state := &State{Config: config}
+		branch, message := state.buildBranchAndMessage(exampleBuildTemplateData.Change, exampleBuildTemplateData.PatchSet)
+		if branch != tc.branch || message != tc.message {
+			t.Errorf("expected %q %q for case %d but got %q %q", tc.branch, tc.message, id, branch, message)
+		}
+	}
+}
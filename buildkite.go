@@ -26,9 +26,16 @@ type Build struct {
 	StartedAt    string           `json:"started_at,omitempty"`
 	FinishedAt   string           `json:"finished_at,omitempty"`
 	RebuiltFrom  *BuildkiteChange `json:"rebuilt_from,omitempty"`
+	// Meta-data the build was created with, including BuildTokenKey for builds we created.
+	MetaData map[string]string `json:"meta_data,omitempty"`
+}
+
+type BuildkitePipeline struct {
+	Slug string `json:"slug,omitempty"`
 }
 
 type BuildkiteWebhook struct {
-	Event string `json:"event"`
-	Build Build  `json:"build"`
+	Event    string            `json:"event"`
+	Build    Build             `json:"build"`
+	Pipeline BuildkitePipeline `json:"pipeline"`
 }
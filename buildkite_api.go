@@ -0,0 +1,115 @@
+package main
+
+// Buildkite REST API endpoints which go-buildkite doesn't wrap.
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+// Cancels a scheduled or running build.
+//
+// buildkite API docs: https://buildkite.com/docs/apis/rest-api/builds#cancel-a-build
+func cancelBuild(client *buildkite.Client, org string, pipeline string, number int) error {
+	u := fmt.Sprintf("v2/organizations/%s/pipelines/%s/builds/%d/cancel", org, pipeline, number)
+
+	req, err := client.NewRequest("PUT", u, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Do(req, nil)
+	return err
+}
+
+// The parts of a job we need which go-buildkite doesn't decode.
+type BuildkiteJob struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	State      string `json:"state"`
+	ExitStatus *int   `json:"exit_status"`
+	// Why the agent stopped the job, eg; "agent_lost" or "agent_stop".  Empty for jobs which exited on their own.
+	SignalReason string `json:"signal_reason"`
+	// True once a job has been retried, the retry shows up as a new job.
+	Retried bool `json:"retried"`
+}
+
+type BuildkiteBuildJobs struct {
+	ID     string         `json:"id"`
+	Number int            `json:"number"`
+	State  string         `json:"state"`
+	WebURL string         `json:"web_url"`
+	Jobs   []BuildkiteJob `json:"jobs"`
+	// Environment and meta-data the build was created with.
+	Env      map[string]string `json:"env"`
+	MetaData map[string]string `json:"meta_data"`
+}
+
+// Fetches a build along with all of its jobs.
+//
+// buildkite API docs: https://buildkite.com/docs/apis/rest-api/builds#get-a-build
+func getBuildJobs(client *buildkite.Client, org string, pipeline string, number int) (*BuildkiteBuildJobs, error) {
+	u := fmt.Sprintf("v2/organizations/%s/pipelines/%s/builds/%d", org, pipeline, number)
+
+	req, err := client.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	build := new(BuildkiteBuildJobs)
+	if _, err := client.Do(req, build); err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+// Returns the jobs of a build which failed and haven't been retried yet.
+func (b *BuildkiteBuildJobs) FailedJobs() []BuildkiteJob {
+	var result []BuildkiteJob
+	for _, job := range b.Jobs {
+		if job.Type != "script" || job.Retried {
+			continue
+		}
+		if job.State == "failed" || job.State == "timed_out" {
+			result = append(result, job)
+		}
+	}
+	return result
+}
+
+// Agent signal reasons which mean the job was killed by the infrastructure rather than failing.
+var infrastructureSignalReasons = []string{"agent_lost", "agent_stop", "agent_refused", "agent_incompatible", "process_run_error"}
+
+// Returns true if a job was lost to the infrastructure.  The agent reports an exit status of -1 when it lost the job.
+func (j BuildkiteJob) InfrastructureFailure() bool {
+	return (j.ExitStatus != nil && *j.ExitStatus == -1) || slices.Contains(infrastructureSignalReasons, j.SignalReason)
+}
+
+// Returns true if a build failed only because jobs were lost to the infrastructure.
+func (b *BuildkiteBuildJobs) InfrastructureFailure() bool {
+	failed := b.FailedJobs()
+	for _, job := range failed {
+		if !job.InfrastructureFailure() {
+			return false
+		}
+	}
+	return len(failed) > 0
+}
+
+// Retries a failed, timed out or canceled job.
+//
+// buildkite API docs: https://buildkite.com/docs/apis/rest-api/jobs#retry-a-job
+func retryJob(client *buildkite.Client, org string, pipeline string, number int, jobID string) error {
+	u := fmt.Sprintf("v2/organizations/%s/pipelines/%s/builds/%d/jobs/%s/retry", org, pipeline, number, jobID)
+
+	req, err := client.NewRequest("PUT", u, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Do(req, nil)
+	return err
+}
@@ -10,10 +10,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"maps"
 	"net/http"
 	"os/exec"
-	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,18 +26,99 @@ import (
 const (
 	// Query to fetch the latest buildUUID from the database given a change number latest patch at head of sequence
 	getLatestBuildQuery = "select id as builduuid from buildkite where changenumber = ? order by patchset desc;"
+	// Query to fetch the most recently added build of a patchset.
+	getLatestPatchsetBuildQuery = "select id, sha1, changeid, changenumber, patchset, coalesce(pipeline, ''), coalesce(number, 0) from buildkite where changenumber = ? and patchset = ? order by rowid desc limit 1;"
+	// Query to fetch the most recent attempt at building a patchset in a pipeline, and the one after it.
+	latestAttemptQuery = "select coalesce(max(attempt), 0) from buildkite where changenumber = ? and patchset = ? and coalesce(pipeline, '') = ?"
+	nextAttemptQuery   = "select coalesce(max(attempt), 0) + 1 from buildkite where changenumber = ? and patchset = ? and coalesce(pipeline, '') = ?"
 )
 
+// Tables created alongside the buildkite table.
+var tables = []string{
+	// Additional changes covered by a build, for builds of a whole topic.
+	"create table if not exists build_changes (id text not null, sha1 text, changeid text, changenumber integer, patchset integer, primary key (id, changenumber));",
+	// Builds of branches and tags after they were updated.
+	"create table if not exists branch_builds (id text not null primary key, project text, ref text, oldrev text, newrev text, pipeline text, number integer, state text, weburl text);",
+	// Bisections of failed branch builds.  revisions holds the candidate commits oldest first as JSON, and good and bad the indexes of the newest passing and oldest failing ones, -1 being oldrev.
+	"create table if not exists bisections (id integer primary key autoincrement, project text, ref text, pipeline text, oldrev text, newrev text, revisions text, good integer, bad integer, state text, culprit text);",
+	// Reverts proposed for changes which broke a branch build.
+	"create table if not exists reverts (changenumber integer not null primary key, revert integer);",
+	// Builds started by bisections, and the candidate they build.
+	"create table if not exists bisect_builds (id text not null primary key, bisection integer, candidate integer);",
+	// Verifications of a patchset, built in each of pipelines, a JSON list.
+	"create table if not exists verification_runs (id integer primary key autoincrement, project text, changenumber integer, patchset integer, pipelines text);",
+	// What hashtags made us do to patchsets, in order of id.  pipelines is a comma separated list.
+	"create table if not exists hashtag_decisions (id integer primary key autoincrement, changenumber integer, patchset integer, hashtag text, decision text, pipelines text);",
+	// Fields of the changes we built which finished messages can't get from the build, as of the last build.
+	"create table if not exists changes (changenumber integer not null primary key, branch text, subject text, url text, ownername text, owneremail text, ownerusername text);",
+	// Changes waiting in the gate queue of their project and branch, in order of id.
+	"create table if not exists gate_queue (id integer primary key autoincrement, project text, branch text, changeid text, changenumber integer, patchset integer, revision text, ref text, state text, build text, weburl text);",
+}
+
+// A column in a database table.
+type column struct {
+	Name string
+	Type string
+}
+
+// Columns added to the build_changes table after it was first created.
+var buildChangesColumns = []column{
+	{"project", "text"},
+	{"run", "integer"},
+}
+
+// Columns added to the buildkite table after it was first created.  Older databases get them added on open.
+var buildkiteColumns = []column{
+	{"pipeline", "text"},
+	{"number", "integer"},
+	{"state", "text"},
+	{"weburl", "text"},
+	{"project", "text"},
+	{"run", "integer"},
+	{"retries", "integer"},
+	{"attempt", "integer"},
+}
+
+// Columns added to the gate_queue table after it was first created.
+var gateQueueColumns = []column{
+	{"attempt", "integer"},
+	{"number", "integer"},
+}
+
 type Commit struct {
 	Sha1         string
 	ChangeId     string
 	ChangeNumber int
 	Patchset     int
+	// Gerrit project of the change, empty for builds recorded before it was tracked.
+	Project string
+	// Buildkite pipeline and build number, needed to talk to the API about the build.  Empty for builds recorded before they were tracked.
+	Pipeline string
+	Number   int
+	// Verification run the build is part of, 0 if it isn't part of one.
+	Run int64
+	// Times the jobs of the build have been retried after infrastructure failures.
+	Retries int
+	// Counts the builds of the patchset in the pipeline from 1, so later retests and rebuilds are newer attempts.
+	// 0 for builds recorded before attempts were tracked.
+	Attempt int
+	// Final state of the build once it finishes, or BuildCanceling while we cancel it.
+	State string
 }
 
+// State recorded for builds we are canceling because their change closed, so their result isn't reported.
+const BuildCanceling = "canceling"
+
 type State struct {
-	// This mutex needs to be locked across anything which generates a uuid or calls {Get,Add}Commit.
+	// Serializes the multi-step database updates of gate queues, bisections, branch builds and reverts.  Never held across network calls.
 	mu sync.Mutex
+	// Serializes the state changes of each gate queue, so changes are built on the right changes and submitted once, in order.
+	// Taken before mu, and never held across network calls.
+	gateQueues Locks[gateQueueKey]
+	// Serializes starting and reporting the builds of each change, so their messages and votes are posted in order.  Taken before mu.
+	changes ChangeLocks
+	// Builds being created, so webhooks which beat Builds.Create back can be matched to them.
+	pending PendingBuilds
 
 	User string
 	Key  string
@@ -44,12 +126,23 @@ type State struct {
 	Token string
 	// Gerrit server to connect to.
 	Server string
-	// Project in gerrit to only accept events from.
+	// Project in gerrit to accept events from, along with any project in Config.
 	Project string
 	// BuildkiteProject in gerrit to only accept events from.
 	BuildkiteProject string
 	// Organization to use in Buildkite for the build.
 	BuildkiteOrganization string
+	// Additional Buildkite pipelines which can be requested with "retest <pipeline>".
+	RetestPipelines []string
+
+	// Per project configuration.
+	Config *Config
+	// Buildkite client for builds started from webhooks rather than gerrit events.
+	Buildkite *buildkite.Client
+	// Gerrit REST API, nil if --gerrit_url isn't set.
+	REST *GerritREST
+	// How reviews are posted, ReviewOverSSH or ReviewOverREST.
+	ReviewTransport string
 
 	// Database to hold commits.
 	DB *sql.DB
@@ -61,18 +154,75 @@ func (s *State) OpenDatabase(database string) {
 	if err != nil {
 		log.Fatalf("Failed to open database: %v", err)
 	}
+	// Builds of different changes are handled concurrently, and sqlite only allows one writer.
+	// Sharing one connection queues them up instead of failing with SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+
+	if err := initDatabase(db); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+
+	s.DB = db
+}
 
+// Creates the tables we need, and upgrades tables created by older versions.
+func initDatabase(db *sql.DB) error {
 	// Create a build counter table with a key of "id", and a "count" column only if it doesn't exist.
 	sqlStmt := `
         create table if not exists buildkite (id text not null primary key, sha1 text, changeid text, changenumber integer, patchset integer);
         `
-	_, err = db.Exec(sqlStmt)
+	if _, err := db.Exec(sqlStmt); err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	if err := addMissingColumns(db, "buildkite", buildkiteColumns); err != nil {
+		return err
+	}
+
+	for _, sqlStmt := range tables {
+		if _, err := db.Exec(sqlStmt); err != nil {
+			return fmt.Errorf("%q: %s", err, sqlStmt)
+		}
+	}
+	if err := addMissingColumns(db, "build_changes", buildChangesColumns); err != nil {
+		return err
+	}
+	return addMissingColumns(db, "gate_queue", gateQueueColumns)
+}
+
+// Adds any of the provided columns which are missing from a table.
+func addMissingColumns(db *sql.DB, table string, columns []column) error {
+	rows, err := db.Query(fmt.Sprintf("pragma table_info(%s)", table))
 	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlStmt)
-		return
+		return err
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	s.DB = db
+	for _, column := range columns {
+		if existing[column.Name] {
+			continue
+		}
+		statement := fmt.Sprintf("alter table %s add column %s %s", table, column.Name, column.Type)
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("%q: %s", err, statement)
+		}
+		log.Printf("Added column %s to %s", column.Name, table)
+	}
+	return nil
 }
 
 func (s *State) CloseDatabase() {
@@ -94,12 +244,12 @@ func (s *State) GetCommit(id string) (Commit, bool) {
 	defer tx.Commit()
 
 	var commit Commit
-	statement, err := tx.PrepareContext(ctx, "select sha1, changeid, changenumber, patchset from buildkite where id = ?")
+	statement, err := tx.PrepareContext(ctx, "select sha1, changeid, changenumber, patchset, coalesce(project, ''), coalesce(pipeline, ''), coalesce(number, 0), coalesce(run, 0), coalesce(retries, 0), coalesce(attempt, 0), coalesce(state, '') from buildkite where id = ?")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = statement.QueryRow(id).Scan(&commit.Sha1, &commit.ChangeId, &commit.ChangeNumber, &commit.Patchset)
+	err = statement.QueryRow(id).Scan(&commit.Sha1, &commit.ChangeId, &commit.ChangeNumber, &commit.Patchset, &commit.Project, &commit.Pipeline, &commit.Number, &commit.Run, &commit.Retries, &commit.Attempt, &commit.State)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.Fatalf("Failed to query: '%v'", err)
@@ -128,6 +278,79 @@ func (s *State) TryGetLatestBuild(changeNumber int) (buildUUID string, ok bool)
 	return buildUUID, true
 }
 
+// Returns the ID and commit of the most recently triggered build of a patchset.
+func (s *State) GetLatestPatchsetBuild(changeNumber int, patchset int) (string, Commit, bool) {
+	var id string
+	var commit Commit
+	err := s.DB.QueryRow(getLatestPatchsetBuildQuery, changeNumber, patchset).Scan(
+		&id, &commit.Sha1, &commit.ChangeId, &commit.ChangeNumber, &commit.Patchset, &commit.Pipeline, &commit.Number)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to query latest build of %d,%d: %v", changeNumber, patchset, err)
+		}
+		return "", commit, false
+	}
+	return id, commit, true
+}
+
+// Returns the most recent attempt at building a patchset in a pipeline, or 0 if none were recorded with attempts.
+func (s *State) LatestAttempt(changeNumber int, patchset int, pipeline string) int {
+	var attempt int
+	if err := s.DB.QueryRow(latestAttemptQuery, changeNumber, patchset, pipeline).Scan(&attempt); err != nil {
+		log.Printf("Failed to query latest attempt of %d,%d in %s: %v", changeNumber, patchset, pipeline, err)
+	}
+	return attempt
+}
+
+// Records the final state of a build.
+func (s *State) SetBuildResult(id string, state string, webURL string) {
+	if _, err := s.DB.Exec("update buildkite set state = ?, weburl = ? where id = ?", state, webURL, id); err != nil {
+		log.Printf("Failed to record result of %s: %v", id, err)
+	}
+}
+
+// Forgets the result of a build which is running again.
+func (s *State) ClearBuildResult(id string) {
+	if _, err := s.DB.Exec("update buildkite set state = null, weburl = null where id = ?", id); err != nil {
+		log.Printf("Failed to clear result of %s: %v", id, err)
+	}
+}
+
+func (s *State) SetBuildRetries(id string, retries int) {
+	if _, err := s.DB.Exec("update buildkite set retries = ? where id = ?", retries, id); err != nil {
+		log.Printf("Failed to record retries of %s: %v", id, err)
+	}
+}
+
+// Records additional changes covered by a build.
+func (s *State) AddBuildChanges(id string, commits []Commit) {
+	for _, commit := range commits {
+		if _, err := s.DB.Exec("insert or replace into build_changes (id, sha1, changeid, changenumber, patchset, project) values (?, ?, ?, ?, ?, ?)",
+			id, commit.Sha1, commit.ChangeId, commit.ChangeNumber, commit.Patchset, commit.Project); err != nil {
+			log.Fatalf("Failed to exec: %s", err)
+		}
+	}
+}
+
+// Returns the additional changes covered by a build.
+func (s *State) GetBuildChanges(id string) []Commit {
+	rows, err := s.DB.Query("select sha1, changeid, changenumber, patchset, coalesce(project, '') from build_changes where id = ? order by rowid", id)
+	if err != nil {
+		log.Fatalf("Failed to query: '%v'", err)
+	}
+	defer rows.Close()
+
+	var result []Commit
+	for rows.Next() {
+		var commit Commit
+		if err := rows.Scan(&commit.Sha1, &commit.ChangeId, &commit.ChangeNumber, &commit.Patchset, &commit.Project); err != nil {
+			log.Fatalf("Failed to scan: '%v'", err)
+		}
+		result = append(result, commit)
+	}
+	return result
+}
+
 // Writes our commit to the database.
 func (s *State) AddCommit(id string, commit Commit) {
 	log.Printf("AddCommit: %#v\n", commit)
@@ -140,11 +363,20 @@ func (s *State) AddCommit(id string, commit Commit) {
 
 	defer tx.Commit()
 
-	statement, err := tx.PrepareContext(ctx, "insert into buildkite (id, sha1, changeid, changenumber, patchset) VALUES (?, ?, ?, ?, ?)")
+	// Builds created with an attempt keep it, everything else is the next attempt.
+	attempt := "(" + nextAttemptQuery + ")"
+	args := []any{id, commit.Sha1, commit.ChangeId, commit.ChangeNumber, commit.Patchset, commit.Project, commit.Pipeline, commit.Number, commit.Run}
+	if commit.Attempt > 0 {
+		attempt = "?"
+		args = append(args, commit.Attempt)
+	} else {
+		args = append(args, commit.ChangeNumber, commit.Patchset, commit.Pipeline)
+	}
+	statement, err := tx.PrepareContext(ctx, "insert into buildkite (id, sha1, changeid, changenumber, patchset, project, pipeline, number, run, attempt) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, "+attempt+")")
 	if err != nil {
 		log.Fatalf("Failed to insert %s", err)
 	}
-	_, err = statement.Exec(id, commit.Sha1, commit.ChangeId, commit.ChangeNumber, commit.Patchset)
+	_, err = statement.Exec(args...)
 	if err != nil {
 		log.Fatalf("Failed to exec: %s", err)
 	}
@@ -152,10 +384,27 @@ func (s *State) AddCommit(id string, commit Commit) {
 
 // Simple application to poll Gerrit for events and trigger builds on buildkite when one happens.
 
+// Extra parameters for a build triggered from a gerrit event.
+type BuildOptions struct {
+	// Buildkite pipeline to build in, defaults to BuildkiteProject.
+	Pipeline string
+	// Extra environment for the build.
+	Env map[string]string
+	// Leave the current vote in place when the build starts instead of resetting it.
+	KeepVote bool
+	// Asked for with a command, which builds even if the commit message asks to skip CI.
+	Requested bool
+}
+
 // Handles a gerrit event and triggers buildkite accordingly.
 func (s *State) handleEvent(eventInfo EventInfo, client *buildkite.Client) {
+	s.triggerBuild(eventInfo, client, BuildOptions{})
+}
+
+// Triggers a build of the patchset in the event with the provided options.
+func (s *State) triggerBuild(eventInfo EventInfo, client *buildkite.Client, options BuildOptions) {
 	// Only work on the desired project.
-	if eventInfo.Project != s.Project {
+	if !s.watchesProject(eventInfo.Project) {
 		log.Printf("Ignoring project: '%s'\n", eventInfo.Project)
 		return
 	}
@@ -174,83 +423,425 @@ func (s *State) handleEvent(eventInfo EventInfo, client *buildkite.Client) {
 	log.Printf("Got a matching change of %s %s %d,%d\n",
 		eventInfo.Change.ID, eventInfo.PatchSet.Revision, eventInfo.Change.Number, eventInfo.PatchSet.Number)
 
-	for {
-		var user *User
-		if eventInfo.Author != nil {
-			user = eventInfo.Author
-		} else if eventInfo.Uploader != nil {
-			user = eventInfo.Uploader
-		} else {
-			log.Fatalf("Failed to find Author or Uploader")
-		}
-
-		// Triggering a build creates a UUID, and we can see events back from the webhook before the command returns.  Lock across the command so nothing access commits while the new UUID is being added.
-		s.mu.Lock()
-
-		// Trigger the build.
-		if build, _, err := client.Builds.Create(
-			s.BuildkiteOrganization, s.BuildkiteProject, &buildkite.CreateBuild{
-				Commit: eventInfo.PatchSet.Revision,
-				Branch: eventInfo.Change.ID,
-				Author: buildkite.Author{
-					Name:  user.Name,
-					Email: user.Email,
-				},
-				Env: map[string]string{
-					"GERRIT_CHANGE_NUMBER": fmt.Sprintf("%d", eventInfo.Change.Number),
-					"GERRIT_PATCH_NUMBER":  fmt.Sprintf("%d", eventInfo.PatchSet.Number),
-				},
-			}); err == nil {
-
-			if build.ID != nil {
-				log.Printf("Scheduled build %s\n", *build.ID)
-				s.AddCommit(*build.ID, Commit{
-					Sha1:         eventInfo.PatchSet.Revision,
-					ChangeId:     eventInfo.Change.ID,
-					ChangeNumber: eventInfo.Change.Number,
-					Patchset:     eventInfo.PatchSet.Number,
-				})
-			}
-			s.mu.Unlock()
+	ci, err := s.ciRequest(eventInfo.Change)
+	if err != nil {
+		log.Printf("Not building %d,%d: %v", eventInfo.Change.Number, eventInfo.PatchSet.Number, err)
+		s.review(eventInfo.Change.Number, eventInfo.PatchSet.Number, Review{
+			Message: fmt.Sprintf("Not building, the commit message asks for something which isn't allowed: %v", err),
+		})
+		return
+	}
+	if ci.Skip && !options.Requested {
+		log.Printf("Not building %d,%d, the commit message skips CI", eventInfo.Change.Number, eventInfo.PatchSet.Number)
+		s.review(eventInfo.Change.Number, eventInfo.PatchSet.Number, Review{
+			Message: fmt.Sprintf("Not building, the commit message skips CI: %s", ci.Reason),
+			Notify:  "NONE",
+		})
+		return
+	}
 
-			if data, err := json.MarshalIndent(build, "", "\t"); err != nil {
-				log.Fatalf("json encode failed: %s", err)
-			} else {
-				log.Printf("%s\n", string(data))
-			}
+	if hashtag := s.skipHashtag(eventInfo.Change); hashtag != "" && !options.Requested {
+		log.Printf("Not building %d,%d, the change has hashtag %s", eventInfo.Change.Number, eventInfo.PatchSet.Number, hashtag)
+		s.AddHashtagDecision(HashtagDecision{
+			ChangeNumber: eventInfo.Change.Number,
+			Patchset:     eventInfo.PatchSet.Number,
+			Hashtag:      hashtag,
+			Decision:     HashtagSkipped,
+		})
+		s.review(eventInfo.Change.Number, eventInfo.PatchSet.Number, Review{
+			Message: fmt.Sprintf("Not building, the change has hashtag #%s.", hashtag),
+			Notify:  "NONE",
+		})
+		return
+	}
 
-			// Now remove the verified from Gerrit and post the link.
-			cmd := exec.Command("ssh",
-				"-p",
-				"29418",
-				"-i",
-				s.Key,
-				s.User+"@"+s.Server,
-				"gerrit",
-				"review",
-				"-m",
-				fmt.Sprintf("\"Build Started: %s\"", *build.WebURL),
-				// Don't email out the initial link to lower the spam.
-				"-n",
-				"NONE",
-				"--label",
-				"Verified=0",
-				fmt.Sprintf("%d,%d", eventInfo.Change.Number, eventInfo.PatchSet.Number))
-
-			log.Printf("Running 'ssh -p 29418 -i %s %s@%s gerrit review -m '\"Build Started: %s\"' -n NONE --label Verified=0 %d,%d' and waiting for it to finish...",
-				s.Key, s.User, s.Server,
-				*build.WebURL, eventInfo.Change.Number, eventInfo.PatchSet.Number)
-			if err := cmd.Run(); err != nil {
-				log.Printf("Command failed with error: %v", err)
-			}
+	pipelines := s.verifyPipelines(eventInfo.Change.Project)
+	hashtagPipelines, hashtags := s.hashtagPipelines(eventInfo.Change)
+	if len(hashtagPipelines) > 0 {
+		pipelines = hashtagPipelines
+	}
+	if len(ci.Pipelines) > 0 {
+		pipelines = ci.Pipelines
+		hashtags = nil
+	}
+	if options.Pipeline != "" {
+		pipelines = []string{options.Pipeline}
+		hashtags = nil
+	}
+	restricted := s.restrictedPipeline(eventInfo.Change)
+	if restricted != "" {
+		log.Printf("Change %d is private, building in %s instead of %s", eventInfo.Change.Number, restricted, strings.Join(pipelines, ", "))
+		pipelines = []string{restricted}
+		hashtags = nil
+	}
+
+	env := gerritBuildEnv(eventInfo.Change, eventInfo.PatchSet)
+	metaData := gerritMetaData(env)
+	branch, message := s.buildBranchAndMessage(eventInfo.Change, eventInfo.PatchSet)
+	for k, v := range s.relationChainEnv(eventInfo) {
+		env[k] = v
+	}
+	for k, v := range ci.Env {
+		env[k] = v
+	}
+	for k, v := range options.Env {
+		env[k] = v
+	}
+
+	topic, err := s.topicChanges(eventInfo)
+	if err != nil {
+		log.Printf("Failed to build topic of %d: %v", eventInfo.Change.Number, err)
+		s.review(eventInfo.Change.Number, eventInfo.PatchSet.Number, Review{
+			Message: fmt.Sprintf("Not building topic %s: %v", eventInfo.Change.Topic, err),
+		})
+		return
+	}
+	var topicCommits []Commit
+	if len(topic) > 0 {
+		members := topicMembers(eventInfo.Change, eventInfo.PatchSet, topic)
+		topicEnv, topicMetaData := topicBuildInfo(eventInfo.Change.Topic, members)
+		for k, v := range topicEnv {
+			env[k] = v
+		}
+		for k, v := range topicMetaData {
+			metaData[k] = v
+		}
+		for _, change := range topic {
+			s.RecordChange(&change.Change)
+			topicCommits = append(topicCommits, Commit{
+				Sha1:         change.CurrentPatchSet.Revision,
+				ChangeId:     change.ID,
+				ChangeNumber: change.Number,
+				Patchset:     change.CurrentPatchSet.Number,
+				Project:      change.Project,
+			})
+		}
+		log.Printf("Building %d changes in topic %s together", len(members), eventInfo.Change.Topic)
+	}
+
+	// Pipelines asked for explicitly are always built, and topic builds cover files of other changes.
+	if options.Pipeline == "" && len(ci.Pipelines) == 0 && len(hashtags) == 0 && restricted == "" && len(topicCommits) == 0 {
+		var skipped []SkippedPipeline
+		pipelines, skipped = s.selectPipelines(eventInfo.Change, eventInfo.PatchSet, pipelines)
+		if len(skipped) > 0 {
+			s.reportSkippedPipelines(eventInfo.Change, eventInfo.PatchSet, pipelines, skipped)
+		}
+		if len(pipelines) == 0 {
+			log.Printf("No pipelines to build %d,%d in", eventInfo.Change.Number, eventInfo.PatchSet.Number)
 			return
+		}
+	}
+
+	var user *User
+	if eventInfo.Author != nil {
+		user = eventInfo.Author
+	} else if eventInfo.Uploader != nil {
+		user = eventInfo.Uploader
+	} else {
+		log.Fatalf("Failed to find Author or Uploader")
+	}
+
+	for _, hashtag := range hashtags {
+		s.AddHashtagDecision(HashtagDecision{
+			ChangeNumber: eventInfo.Change.Number,
+			Patchset:     eventInfo.PatchSet.Number,
+			Hashtag:      hashtag,
+			Decision:     HashtagBuilt,
+			Pipelines:    pipelines,
+		})
+	}
+
+	// Remember what finished messages need to know about the change.
+	s.RecordChange(eventInfo.Change)
+	// Group the builds so their results can be combined into one vote.  A single pipeline asked for explicitly is
+	// built into the patchset's latest run instead, replacing that pipeline's build, so the others still count.
+	var run int64
+	if latest, ok := s.GetLatestPatchsetRun(eventInfo.Change.Number, eventInfo.PatchSet.Number); ok && len(pipelines) == 1 && (options.Pipeline != "" || restricted != "") {
+		s.AddRunPipeline(latest, pipelines[0])
+		run = latest.ID
+	} else {
+		run = s.AddVerificationRun(eventInfo.Change.Project, eventInfo.Change.Number, eventInfo.PatchSet.Number, pipelines)
+	}
+
+	for _, pipeline := range pipelines {
+		// Hold the change until the started message is posted, so a quick result can't be reset by it.
+		unlock := s.changes.Lock(eventInfo.Change.Number)
+		// The run and attempt go in the meta-data too, so the build can be recovered into its run if we lose track of it.
+		attempt := s.LatestAttempt(eventInfo.Change.Number, eventInfo.PatchSet.Number, pipeline) + 1
+		pipelineMetaData := maps.Clone(metaData)
+		pipelineMetaData[BuildRunKey] = strconv.FormatInt(run, 10)
+		pipelineMetaData[BuildAttemptKey] = strconv.Itoa(attempt)
+		// We can see events back from the webhook before Buildkite answers, createBuild records the build before they are handled.
+		build := s.createBuild(client, pipeline, &buildkite.CreateBuild{
+			Commit:  eventInfo.PatchSet.Revision,
+			Branch:  branch,
+			Message: message,
+			Author: buildkite.Author{
+				Name:  user.Name,
+				Email: user.Email,
+			},
+			Env:      env,
+			MetaData: pipelineMetaData,
+		}, func(build *buildkite.Build) {
+			log.Printf("Scheduled build %s\n", *build.ID)
+			commit := Commit{
+				Sha1:         eventInfo.PatchSet.Revision,
+				ChangeId:     eventInfo.Change.ID,
+				ChangeNumber: eventInfo.Change.Number,
+				Patchset:     eventInfo.PatchSet.Number,
+				Project:      eventInfo.Change.Project,
+				Pipeline:     pipeline,
+				Run:          run,
+				Attempt:      attempt,
+			}
+			if build.Number != nil {
+				commit.Number = *build.Number
+			}
+			s.AddCommit(*build.ID, commit)
+			s.AddBuildChanges(*build.ID, topicCommits)
+		})
+
+		if data, err := json.MarshalIndent(build, "", "\t"); err != nil {
+			log.Fatalf("json encode failed: %s", err)
 		} else {
-			s.mu.Unlock()
-			log.Printf("Failed to trigger build: %s", err)
-			log.Printf("Trying again in 30 seconds")
-			time.Sleep(30 * time.Second)
+			log.Printf("%s\n", string(data))
+		}
+
+		// Now remove the verified from Gerrit and post the link.
+		config := s.projectConfig(eventInfo.Change.Project)
+		data := MessageTemplateData{
+			Change:   eventInfo.Change,
+			PatchSet: eventInfo.PatchSet,
+			Trailers: ci.Trailers,
+			Build:    MessageBuild{URL: *build.WebURL, Pipeline: pipeline, NonVoting: !*s.pipelineConfig(eventInfo.Change.Project, pipeline).Voting},
+		}
+		if build.Number != nil {
+			data.Build.Number = *build.Number
+		}
+		review := Review{
+			Message: config.renderMessage(MessageStarted, data),
+			// Don't email out the initial link to lower the spam.
+			Notify: "NONE",
+			Labels: s.pipelineConfig(eventInfo.Change.Project, pipeline).resetLabels(),
+		}
+		if options.KeepVote {
+			review.Labels = nil
 		}
+		s.review(eventInfo.Change.Number, eventInfo.PatchSet.Number, review)
+		for _, commit := range topicCommits {
+			data.Change, data.PatchSet = s.recordedChange(commit)
+			data.TopicChange = eventInfo.Change.Number
+			s.review(commit.ChangeNumber, commit.Patchset, Review{
+				Message: s.projectConfig(commit.Project).renderMessage(MessageStarted, data),
+				Notify:  "NONE",
+				Labels:  s.pipelineConfig(commit.Project, pipeline).resetLabels(),
+			})
+		}
+		unlock()
+	}
+}
+
+// Creates a build, retrying every 30 seconds until Buildkite accepts it.
+// record is called once with the build, before any webhook for it is handled.
+func (s *State) createBuild(client *buildkite.Client, pipeline string, create *buildkite.CreateBuild, record func(build *buildkite.Build)) *buildkite.Build {
+	for {
+		build, err := s.tryCreateBuild(client, pipeline, create, record)
+		if err == nil {
+			return build
+		}
+		log.Printf("Failed to create build in %s: %v", pipeline, err)
+		log.Printf("Trying again in 30 seconds")
+		time.Sleep(30 * time.Second)
+	}
+}
+
+// Creates a build once.  The build is created with a token in its meta-data, so a webhook which arrives before
+// Buildkite answers can call record instead.  Either way record is called once, before the webhook is handled.
+func (s *State) tryCreateBuild(client *buildkite.Client, pipeline string, create *buildkite.CreateBuild, record func(build *buildkite.Build)) (*buildkite.Build, error) {
+	token := s.pending.Add(record)
+	defer s.pending.Remove(token)
+
+	withToken := *create
+	withToken.MetaData = maps.Clone(create.MetaData)
+	if withToken.MetaData == nil {
+		withToken.MetaData = map[string]string{}
+	}
+	withToken.MetaData[BuildTokenKey] = token
+
+	build, _, err := client.Builds.Create(s.BuildkiteOrganization, pipeline, &withToken)
+	if err != nil {
+		return nil, err
+	}
+	if build.ID != nil {
+		s.pending.Record(token, build)
+	}
+	return build, nil
+}
+
+// Returns the IDs and commits of the builds of a change which haven't finished yet.
+func (s *State) GetRunningBuilds(changeNumber int) map[string]Commit {
+	rows, err := s.DB.Query("select id, sha1, changeid, changenumber, patchset, coalesce(pipeline, ''), coalesce(number, 0) from buildkite where changenumber = ? and state is null", changeNumber)
+	if err != nil {
+		log.Fatalf("Failed to query: '%v'", err)
+	}
+	defer rows.Close()
+
+	result := map[string]Commit{}
+	for rows.Next() {
+		var id string
+		var commit Commit
+		if err := rows.Scan(&id, &commit.Sha1, &commit.ChangeId, &commit.ChangeNumber, &commit.Patchset, &commit.Pipeline, &commit.Number); err != nil {
+			log.Fatalf("Failed to scan: '%v'", err)
+		}
+		result[id] = commit
+	}
+	return result
+}
+
+// Cancels all the scheduled and running builds of a change, marking them so their results aren't reported.
+func (s *State) cancelChangeBuilds(client *buildkite.Client, changeNumber int) {
+	unlock := s.changes.Lock(changeNumber)
+	builds := s.GetRunningBuilds(changeNumber)
+	for id := range builds {
+		s.SetBuildResult(id, BuildCanceling, "")
+	}
+	unlock()
+
+	for id, commit := range builds {
+		if commit.Pipeline == "" || commit.Number == 0 {
+			log.Printf("Can't cancel build %s of %d, it was recorded without its build number", id, changeNumber)
+			continue
+		}
+		log.Printf("Canceling build %s #%d of %d,%d", commit.Pipeline, commit.Number, changeNumber, commit.Patchset)
+		if err := cancelBuild(client, s.BuildkiteOrganization, commit.Pipeline, commit.Number); err != nil {
+			log.Printf("Failed to cancel build %s #%d: %v", commit.Pipeline, commit.Number, err)
+		}
+	}
+}
+
+// Retries the failed jobs of the latest build of the patchset in the event.
+// The retried jobs stay in the same build, so the vote is posted by the usual build.finished handling once they finish.
+func (s *State) retryFailedJobs(eventInfo EventInfo, client *buildkite.Client) {
+	changeNumber, patchset := eventInfo.Change.Number, eventInfo.PatchSet.Number
+
+	ids := s.patchsetRetryBuilds(changeNumber, patchset)
+	if len(ids) == 0 {
+		s.review(changeNumber, patchset, Review{
+			Message: fmt.Sprintf("retry-failed: no earlier build of patchset %d to retry, building the whole patchset instead.", patchset),
+			Notify:  "NONE",
+		})
+		s.triggerBuild(eventInfo, client, BuildOptions{Requested: true})
+		return
+	}
+
+	var lines, unchanged []string
+	labels := map[string]string{}
+	for _, id := range ids {
+		commit, ok := s.GetCommit(id)
+		if !ok {
+			continue
+		}
+		build, err := getBuildJobs(client, s.BuildkiteOrganization, commit.Pipeline, commit.Number)
+		if err != nil {
+			log.Printf("Failed to fetch build %s #%d: %v", commit.Pipeline, commit.Number, err)
+			lines = append(lines, fmt.Sprintf("retry-failed: failed to fetch build %s #%d from Buildkite.", commit.Pipeline, commit.Number))
+			continue
+		}
+
+		failed := build.FailedJobs()
+		if len(failed) == 0 {
+			unchanged = append(unchanged, build.WebURL)
+			continue
+		}
+
+		// Hold the change so the result of a quickly retried job can't be recorded before the old one is cleared.
+		unlock := s.changes.Lock(changeNumber)
+		var retried []string
+		for _, job := range failed {
+			if err := retryJob(client, s.BuildkiteOrganization, commit.Pipeline, commit.Number, job.ID); err != nil {
+				log.Printf("Failed to retry job %s of build %s #%d: %v", job.ID, commit.Pipeline, commit.Number, err)
+				continue
+			}
+			log.Printf("Retried job %s (%s) of build %s #%d", job.ID, job.Name, commit.Pipeline, commit.Number)
+			retried = append(retried, job.Name)
+		}
+		if len(retried) > 0 {
+			// The build is running again, so it can be canceled and its run waits for it.
+			s.ClearBuildResult(id)
+		}
+		unlock()
+
+		if len(retried) == 0 {
+			lines = append(lines, fmt.Sprintf("retry-failed: failed to retry the jobs of %s.", build.WebURL))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("Retrying %d failed jobs (%s): %s", len(retried), strings.Join(retried, ", "), build.WebURL))
+		// The build is running again, so remove the vote until it finishes.
+		for label, value := range s.commitPipelineConfig(commit).resetLabels() {
+			labels[label] = value
+		}
+	}
+
+	if len(lines) == 0 {
+		s.review(changeNumber, patchset, Review{
+			Message: fmt.Sprintf("retry-failed: %s has no failed jobs to retry.", strings.Join(unchanged, ", ")),
+			Notify:  "NONE",
+		})
+		return
+	}
+	review := Review{Message: strings.Join(lines, "\n")}
+	if len(labels) > 0 {
+		review.Notify = "NONE"
+		review.Labels = labels
+	}
+	s.review(changeNumber, patchset, review)
+}
+
+// Returns the ids of the builds retry-failed retries on a patchset: the latest build of each pipeline in its latest run, or its
+// latest build if it was built before runs were recorded.  Results carried forward from other patchsets have no build
+// to retry.
+func (s *State) patchsetRetryBuilds(changeNumber int, patchset int) []string {
+	run, ok := s.GetLatestPatchsetRun(changeNumber, patchset)
+	if !ok {
+		id, commit, ok := s.GetLatestPatchsetBuild(changeNumber, patchset)
+		if !ok || commit.Pipeline == "" || commit.Number == 0 {
+			return nil
+		}
+		return []string{id}
+	}
+
+	builds := s.GetRunBuilds(run.ID)
+	var result []string
+	for _, pipeline := range run.Pipelines {
+		build, ok := builds[pipeline]
+		if !ok || build.Number == 0 {
+			continue
+		}
+		result = append(result, build.ID)
+	}
+	return result
+}
+
+// Handles a finished build of a change, reporting its result unless the change closed while it ran.
+func (s *State) handleChangeBuildFinished(build Build) {
+	c, ok := s.GetCommit(build.ID)
+	if !ok {
+		log.Printf("Unknown commit, ID: %s", build.ID)
+		return
+	}
+
+	unlock := s.changes.Lock(c.ChangeNumber)
+	defer unlock()
+	// Read it again now nothing else is changing it.
+	commit, _ := s.GetCommit(build.ID)
+	others := s.GetBuildChanges(build.ID)
+	if commit.State == BuildCanceling {
+		// Canceled because the change closed, nobody needs to hear about it.
+		log.Printf("Build %s of closed change %d finished as %s", build.ID, commit.ChangeNumber, build.State)
+		s.SetBuildResult(build.ID, build.State, build.WebURL)
+		return
 	}
+	s.reportBuildFinished(commit, others, build)
 }
 
 func (s *State) handle(w http.ResponseWriter, r *http.Request) {
@@ -283,95 +874,65 @@ func (s *State) handle(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// We've successfully received the webhook.  Spawn a goroutine in case the mutex is blocked so we don't block this thread.
+		// We've successfully received the webhook.  Spawn a goroutine in case the change is locked so we don't block this thread.
 		f := func() {
+			// Builds we are still creating are recorded first, so they are known below.
+			s.recordPendingBuild(webhook.Build)
+
 			if webhook.Event == "build.running" {
 				if webhook.Build.RebuiltFrom != nil {
-					s.mu.Lock()
 					if c, ok := s.GetCommit(webhook.Build.RebuiltFrom.ID); ok {
+						// Hold the change across the started message, so the result of the rebuild is posted after it.
+						unlock := s.changes.Lock(c.ChangeNumber)
 						log.Printf("Detected a rebuild of %s for build %s", webhook.Build.RebuiltFrom.ID, webhook.Build.ID)
 
 						// only add commit to DB if not already there
 						// if it is already there then this is probably a retry of a step
 						if _, ok := s.GetCommit(webhook.Build.ID); !ok {
+							c.Number = webhook.Build.Number
+							// Rebuilds are a new attempt.
+							c.Attempt = 0
 							s.AddCommit(webhook.Build.ID, c)
+							s.AddBuildChanges(webhook.Build.ID, s.GetBuildChanges(webhook.Build.RebuiltFrom.ID))
 						} else {
 							log.Printf("This is a retried step.")
 						}
 
 						// And now remove the vote since the rebuild started.
-						cmd := exec.Command("ssh",
-							"-p",
-							"29418",
-							"-i",
-							s.Key,
-							s.User+"@"+s.Server,
-							"gerrit",
-							"review",
-							"-m",
-							fmt.Sprintf("\"Build Started: %s\"", webhook.Build.WebURL),
-							// Don't email out the initial link to lower the spam.
-							"-n",
-							"NONE",
-							"--label",
-							"Verified=0",
-							fmt.Sprintf("%d,%d", c.ChangeNumber, c.Patchset))
-
-						log.Printf("Running 'ssh -p 29418 -i %s %s@%s gerrit review -m '\"Build Started: %s\"' -n NONE --label Verified=0 %d,%d' and waiting for it to finish...",
-							s.Key, s.User, s.Server,
-							webhook.Build.WebURL, c.ChangeNumber, c.Patchset)
-						if err := cmd.Run(); err != nil {
-							log.Printf("Command failed with error: %v", err)
+						for i, commit := range append([]Commit{c}, s.GetBuildChanges(webhook.Build.ID)...) {
+							data := MessageTemplateData{
+								Build: MessageBuild{URL: webhook.Build.WebURL, Number: webhook.Build.Number, Pipeline: c.Pipeline, NonVoting: !*s.commitPipelineConfig(c).Voting},
+							}
+							data.Change, data.PatchSet = s.recordedChange(commit)
+							if i > 0 {
+								data.TopicChange = c.ChangeNumber
+							}
+							s.review(commit.ChangeNumber, commit.Patchset, Review{
+								Message: s.commitProjectConfig(commit).renderMessage(MessageStarted, data),
+								// Don't email out the initial link to lower the spam.
+								Notify: "NONE",
+								Labels: s.pipelineConfig(commit.Project, c.Pipeline).resetLabels(),
+							})
 						}
+						unlock()
 					}
-					s.mu.Unlock()
 				}
 			} else if webhook.Event == "build.finished" {
-				var commit *Commit
-				{
-					s.mu.Lock()
-					if c, ok := s.GetCommit(webhook.Build.ID); ok {
-						commit = &c
-					}
-					s.mu.Unlock()
-				}
-
-				if commit == nil {
+				if !s.buildKnown(webhook.Build.ID) && !s.awaitUnknownBuild(webhook) {
 					log.Printf("Unknown commit, ID: %s", webhook.Build.ID)
-				} else {
-					var verify string
-					var status string
-
-					if webhook.Build.State == "passed" {
-						verify = "+1"
-						status = "Succeeded"
-					} else {
-						verify = "-1"
-						status = "Failed"
-					}
-
-					cmd := exec.Command("ssh",
-						"-p",
-						"29418",
-						"-i",
-						s.Key,
-						s.User+"@"+s.Server,
-						"gerrit",
-						"review",
-						"-m",
-						fmt.Sprintf("\"Build %s: %s\"", status, webhook.Build.WebURL),
-						"--label",
-						fmt.Sprintf("Verified=%s", verify),
-						fmt.Sprintf("%d,%d", commit.ChangeNumber, commit.Patchset))
-
-					log.Printf("Running 'ssh -p 29418 -i %s %s@%s gerrit review -m '\"Build %s: %s\"' --label Verified=%s %d,%d' and waiting for it to finish...",
-						s.Key, s.User, s.Server,
-						status, webhook.Build.WebURL, verify, commit.ChangeNumber, commit.Patchset)
-					if err := cmd.Run(); err != nil {
-						log.Printf("Command failed with error: %v", err)
-					}
-
+					return
+				}
+				if s.handleGateBuildFinished(webhook.Build) {
+					return
+				}
+				if s.handleBranchBuildFinished(webhook.Build) {
+					return
 				}
+				if s.handleBisectBuildFinished(webhook.Build) {
+					return
+				}
+
+				s.handleChangeBuildFinished(webhook.Build)
 				if webhook.Build.State == "passed" {
 					log.Printf("Passed build %s: %s", webhook.Build.ID, webhook.Build.Commit)
 				} else {
@@ -393,6 +954,75 @@ func (s *State) handle(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// A review to post on a patchset.
+type Review struct {
+	Message string
+	// Who gerrit should email about the review, empty for gerrit's default.
+	Notify string
+	// Label votes to apply, for example "Verified" -> "+1".
+	Labels map[string]string
+	// Submit the patchset along with the review.
+	Submit bool
+}
+
+// Quotes an argument so gerrit's ssh command line parser passes it through untouched.
+func gerritQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// Ways of posting reviews.
+const (
+	ReviewOverSSH  = "ssh"
+	ReviewOverREST = "rest"
+)
+
+// Posts a review on a patchset with the configured transport.  Failures are logged, and returned for callers which care.
+func (s *State) review(changeNumber int, patchset int, review Review) error {
+	if s.ReviewTransport == ReviewOverREST {
+		if err := s.REST.Review(changeNumber, patchset, review); err != nil {
+			log.Printf("Failed to review %d,%d: %v", changeNumber, patchset, err)
+			return err
+		}
+		return nil
+	}
+	return s.sshReview(changeNumber, patchset, review)
+}
+
+// Posts a review on a patchset with "gerrit review" over ssh.
+func (s *State) sshReview(changeNumber int, patchset int, review Review) error {
+	args := []string{"gerrit", "review"}
+	if review.Message != "" {
+		args = append(args, "-m", gerritQuote(review.Message))
+	}
+	if review.Notify != "" {
+		args = append(args, "-n", review.Notify)
+	}
+	labels := make([]string, 0, len(review.Labels))
+	for label := range review.Labels {
+		labels = append(labels, label)
+	}
+	slices.Sort(labels)
+	for _, label := range labels {
+		args = append(args, "--label", fmt.Sprintf("%s=%s", label, review.Labels[label]))
+	}
+	if review.Submit {
+		args = append(args, "--submit")
+	}
+	args = append(args, fmt.Sprintf("%d,%d", changeNumber, patchset))
+
+	cmd := exec.Command("ssh", append([]string{"-p", "29418", "-i", s.Key, s.User + "@" + s.Server}, args...)...)
+
+	log.Printf("Running 'ssh -p 29418 -i %s %s@%s %s' and waiting for it to finish...",
+		s.Key, s.User, s.Server, strings.Join(args, " "))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("Command failed with error: %v: %s", err, stderr.String())
+		return fmt.Errorf("gerrit review failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
 func (s *State) listUsers() []string {
 	cmd := exec.Command("ssh", "-i", s.Key, "-p", "29418", fmt.Sprintf("%s@%s", s.User, s.Server), "gerrit", "ls-members", "'Verified Users'", "--recursive")
 
@@ -462,6 +1092,12 @@ func main() {
 	buildkiteProject := flag.String("buildkite_project", "ci", "Buildkite project to trigger")
 	buildkiteOrganization := flag.String("organization", "realtimeroboticsgroup", "Project to filter events for")
 	database := flag.String("database", "./buildkite.db", "Database to store builds in.")
+	gerritURL := flag.String("gerrit_url", "", "Base URL of gerrit's REST API, needed to propose reverts")
+	gerritHTTPUser := flag.String("gerrit_http_user", "", "User for gerrit's REST API, defaults to --user")
+	gerritHTTPPassword := flag.String("gerrit_http_password", "", "HTTP password for gerrit's REST API")
+	configFile := flag.String("config", "", "JSON file with per project configuration")
+	reviewTransport := flag.String("review_transport", ReviewOverSSH, "How to post reviews, 'ssh' or 'rest' to use --gerrit_url")
+	retestPipelines := flag.String("retest_pipelines", "", "Comma separated list of additional Buildkite pipelines which can be requested with 'retest <pipeline>'")
 
 	flag.BoolVar(&flagEnableCancelOnNewerPatchset, "cancel_on_newer_patchset", false, "Cancel previous patchset builds when a newer patchset is created")
 
@@ -475,6 +1111,40 @@ func main() {
 		BuildkiteProject:      *buildkiteProject,
 		Project:               *project,
 		BuildkiteOrganization: *buildkiteOrganization,
+		ReviewTransport:       *reviewTransport,
+	}
+	if *retestPipelines != "" {
+		state.RetestPipelines = strings.Split(*retestPipelines, ",")
+	}
+
+	if *gerritURL != "" {
+		httpUser := *gerritHTTPUser
+		if httpUser == "" {
+			httpUser = *user
+		}
+		state.REST = NewGerritREST(*gerritURL, httpUser, *gerritHTTPPassword)
+	}
+	switch state.ReviewTransport {
+	case ReviewOverSSH:
+	case ReviewOverREST:
+		if state.REST == nil {
+			log.Fatalf("--review_transport=%s needs --gerrit_url", ReviewOverREST)
+		}
+	default:
+		log.Fatalf("Unknown --review_transport %q, expected %q or %q", state.ReviewTransport, ReviewOverSSH, ReviewOverREST)
+	}
+
+	if *configFile != "" {
+		config, err := LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		if state.REST == nil {
+			if err := config.ValidateWithoutREST(); err != nil {
+				log.Fatalf("Failed to load config: %v", err)
+			}
+		}
+		state.Config = config
 	}
 
 	state.OpenDatabase(*database)
@@ -504,6 +1174,8 @@ func main() {
 	}
 
 	client := buildkite.NewClient(config.Client())
+	state.Buildkite = client
+	state.resumeGateQueues()
 
 	for {
 		args := fmt.Sprintf("-o ServerAliveInterval=10 -o ServerAliveCountMax=3 -i %s -p 29418 %s@%s gerrit stream-events", state.Key, state.User, state.Server)
@@ -535,57 +1207,34 @@ func main() {
 
 			switch eventInfo.Type {
 			case "assignee-changed":
-			case "change-abandoned":
-			case "change-deleted":
-			case "change-merged":
+			case "change-abandoned", "change-deleted", "change-merged":
+				state.handleGateChangeUpdated(eventInfo)
+				state.handleChangeClosed(eventInfo, client)
 			case "change-restored":
+				state.handleChangeRestored(eventInfo, client)
 			case "comment-added":
-				if !state.authorizedUser(eventInfo) {
-					continue
-				}
-
-				if matched, _ := regexp.MatchString(`(?m)^retest$`, eventInfo.Comment); !matched {
-					continue
-				}
-
-				state.handleEvent(eventInfo, client)
+				state.handleComment(eventInfo, client)
+				state.handleTriggerLabel(eventInfo, client)
+				state.handleGateApproval(eventInfo, client)
 			case "dropped-output":
 			case "hashtags-changed":
+				state.handleHashtagsChanged(eventInfo, client)
 			case "project-created":
 			case "patchset-created":
+				state.handleGateChangeUpdated(eventInfo)
 				if !state.authorizedUser(eventInfo) {
 					continue
 				}
-				state.handleEvent(eventInfo, client)
+				state.handlePatchsetCreated(eventInfo, client)
+				state.rebuildDescendants(eventInfo, client)
 			case "ref-updated":
-				if eventInfo.RefUpdate.Project != state.Project {
-					break
-				}
-				if eventInfo.RefUpdate.RefName != "refs/heads/master" && eventInfo.RefUpdate.RefName != "refs/heads/main" {
-					break
-				}
-				// Eg; "main" or "master"
-				branch := strings.Split(eventInfo.RefUpdate.RefName, "/")[2]
-
-				if build, _, err := client.Builds.Create(
-					state.BuildkiteOrganization, state.BuildkiteProject, &buildkite.CreateBuild{
-						Commit: eventInfo.RefUpdate.NewRev,
-						Branch: branch,
-						Author: buildkite.Author{
-							Name:  eventInfo.Submitter.Name,
-							Email: eventInfo.Submitter.Email,
-						},
-					}); err == nil {
-					log.Printf("Scheduled %s build %s\n", branch, *build.ID)
-				} else {
-					log.Printf("Failed to schedule %s build %v", branch, err)
-				}
-
+				state.handleRefUpdated(eventInfo, client)
 			case "reviewer-added":
 			case "reviewer-deleted":
 			case "topic-changed":
-			case "wip-state-changed":
-			case "private-state-changed":
+				state.handleTopicChanged(eventInfo, client)
+			case "wip-state-changed", "private-state-changed":
+				state.handleDraftStateChanged(eventInfo, client)
 			case "vote-deleted":
 			case "ref-replicated":
 			case "ref-replication-done":
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"sync"
 	"testing"
 
 	"database/sql"
 
+	"github.com/buildkite/go-buildkite/buildkite"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -17,11 +23,8 @@ var (
 )
 
 func setupDatabase(t *testing.T, statements ...string) (*os.File, *sql.DB) {
-	cwd, err := os.Getwd()
-	if err != nil {
-		t.Fatalf("failed in setup: %s", err)
-	}
-	fh, err := os.CreateTemp(cwd, "gepdb")
+	// In a directory the test removes, so failed runs don't leave databases behind.
+	fh, err := os.CreateTemp(t.TempDir(), "gepdb")
 	if err != nil {
 		t.Fatalf("failed in setup: %s", err)
 	}
@@ -43,6 +46,19 @@ func setupDatabase(t *testing.T, statements ...string) (*os.File, *sql.DB) {
 	return fh, db
 }
 
+// Returns a State with a fresh, initialized database which is closed when the test finishes.
+func setupTestState(t *testing.T) *State {
+	dbFile, db := setupDatabase(t)
+	t.Cleanup(func() {
+		db.Close()
+		dbFile.Close()
+	})
+	if err := initDatabase(db); err != nil {
+		t.Fatalf("failed in setup: %s", err)
+	}
+	return &State{DB: db}
+}
+
 func TestTryLatestBuildCases(t *testing.T) {
 	type testCase struct {
 		statements  []string
@@ -78,7 +94,6 @@ func TestTryLatestBuildCases(t *testing.T) {
 		defer func() {
 			db.Close()
 			dbFile.Close()
-			os.Remove(dbFile.Name())
 		}()
 		state := &State{
 			DB: db,
@@ -96,3 +111,91 @@ func TestTryLatestBuildCases(t *testing.T) {
 	}
 
 }
+
+func TestGetLatestPatchsetBuild(t *testing.T) {
+	// Start from the original schema to make sure it gets upgraded.
+	dbFile, db := setupDatabase(t, append(
+		cannedCreateDatabase,
+		[]string{"insert into buildkite (id, sha1, changeid, changenumber, patchset) values ('old-1', 'abc', 'I123', 1234, 1)"}...,
+	)...)
+	defer func() {
+		db.Close()
+		dbFile.Close()
+	}()
+	if err := initDatabase(db); err != nil {
+		t.Fatalf("failed to upgrade database: %s", err)
+	}
+
+	state := &State{
+		DB: db,
+	}
+
+	// Rows from before the upgrade have no pipeline or number.
+	id, commit, ok := state.GetLatestPatchsetBuild(1234, 1)
+	if !ok || id != "old-1" || commit.Pipeline != "" || commit.Number != 0 {
+		t.Fatalf("unexpected latest build %s %#v %v", id, commit, ok)
+	}
+
+	state.AddCommit("new-1", Commit{Sha1: "def", ChangeId: "I123", ChangeNumber: 1234, Patchset: 2, Pipeline: "ci", Number: 7})
+	state.AddCommit("new-2", Commit{Sha1: "def", ChangeId: "I123", ChangeNumber: 1234, Patchset: 2, Pipeline: "ci", Number: 8})
+
+	id, commit, ok = state.GetLatestPatchsetBuild(1234, 2)
+	if !ok || id != "new-2" || commit.Pipeline != "ci" || commit.Number != 8 {
+		t.Fatalf("unexpected latest build %s %#v %v", id, commit, ok)
+	}
+
+	if _, _, ok := state.GetLatestPatchsetBuild(1234, 3); ok {
+		t.Fatalf("expected no build for patchset 3")
+	}
+
+	// Upgrading twice is harmless.
+	if err := initDatabase(db); err != nil {
+		t.Fatalf("failed to upgrade database again: %s", err)
+	}
+}
+
+// Returns a buildkite client which talks to the provided test server.
+func testBuildkiteClient(t *testing.T, server *httptest.Server) *buildkite.Client {
+	client := buildkite.NewClient(server.Client())
+	baseURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatalf("failed in setup: %s", err)
+	}
+	client.BaseURL = baseURL
+	return client
+}
+
+func TestCancelChangeBuilds(t *testing.T) {
+	state := setupTestState(t)
+
+	var mu sync.Mutex
+	var canceled []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		canceled = append(canceled, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		fmt.Fprintf(w, "{}")
+	}))
+	defer server.Close()
+
+	state.BuildkiteOrganization = "org"
+	state.AddCommit("running", Commit{ChangeNumber: 1234, Patchset: 2, Pipeline: "ci", Number: 7})
+	state.AddCommit("finished", Commit{ChangeNumber: 1234, Patchset: 1, Pipeline: "ci", Number: 6})
+	state.SetBuildResult("finished", "passed", "https://buildkite.com/6")
+	state.AddCommit("other", Commit{ChangeNumber: 9999, Patchset: 1, Pipeline: "ci", Number: 8})
+
+	state.cancelChangeBuilds(testBuildkiteClient(t, server), 1234)
+
+	if len(canceled) != 1 || canceled[0] != "PUT /v2/organizations/org/pipelines/ci/builds/7/cancel" {
+		t.Fatalf("unexpected requests %v", canceled)
+	}
+	if commit, _ := state.GetCommit("running"); commit.State != BuildCanceling {
+		t.Fatalf("expected the running build to be marked canceling but got %q", commit.State)
+	}
+	if commit, _ := state.GetCommit("finished"); commit.State != "passed" {
+		t.Fatalf("expected the finished build to be untouched but got %q", commit.State)
+	}
+	if builds := state.GetRunningBuilds(9999); len(builds) != 1 {
+		t.Fatalf("expected the other change to keep running but got %v", builds)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+// Carrying the Verified result forward onto patchsets which don't change the code.
+
+import (
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+// Id of the row recording the result of a pipeline carried forward onto a patchset.
+func carriedForwardID(changeNumber int, patchset int, pipeline string) string {
+	return fmt.Sprintf("carried-forward-%d-%d-%s", changeNumber, patchset, pipeline)
+}
+
+// Handles a patchset-created event, skipping drafts and carrying the previous result forward if the project asks for it.
+func (s *State) handlePatchsetCreated(eventInfo EventInfo, client *buildkite.Client) {
+	if eventInfo.Change == nil || eventInfo.PatchSet == nil || !s.watchesProject(eventInfo.Project) {
+		s.handleEvent(eventInfo, client)
+		return
+	}
+
+	// Changes we upload ourselves, like reverts, are built when we create them.
+	if eventInfo.Uploader != nil && eventInfo.Uploader.Username == s.User {
+		log.Printf("Not building %d,%d, we uploaded it", eventInfo.Change.Number, eventInfo.PatchSet.Number)
+		return
+	}
+
+	if reason := s.skipReason(eventInfo.Change); reason != "" {
+		log.Printf("Not building %d,%d, the change is %s", eventInfo.Change.Number, eventInfo.PatchSet.Number, reason)
+		return
+	}
+
+	config := s.projectConfig(eventInfo.Project)
+	if !slices.Contains(config.CarryForwardKinds, eventInfo.PatchSet.Kind) {
+		s.handleEvent(eventInfo, client)
+		return
+	}
+
+	changeNumber, patchset := eventInfo.Change.Number, eventInfo.PatchSet.Number
+	run, ok := s.GetLatestPatchsetRun(changeNumber, patchset-1)
+	var builds map[string]RunBuild
+	var labels map[string]string
+	if ok {
+		builds = s.GetRunBuilds(run.ID)
+		labels = s.runVotes(run, builds)
+	}
+	if !ok || !s.runCompleted(run, builds) || len(labels) == 0 {
+		log.Printf("No result for %d,%d to carry forward, building", changeNumber, patchset-1)
+		s.handleEvent(eventInfo, client)
+		return
+	}
+
+	status := "Succeeded"
+	for _, pipeline := range run.Pipelines {
+		if *s.pipelineConfig(run.Project, pipeline).Voting && builds[pipeline].State != "passed" {
+			status = "Failed"
+		}
+	}
+	message := fmt.Sprintf("Build %s on patchset %d, carried forward since patchset %d is a %s.\n\n%s",
+		status, patchset-1, patchset, eventInfo.PatchSet.Kind, s.runStatus(run, builds))
+
+	switch config.CarryForwardMode {
+	case CarryForwardCopy:
+		log.Printf("Carrying run %d forward from %d,%d to %d,%d", run.ID, changeNumber, patchset-1, changeNumber, patchset)
+		// Record the copied results as a run of the new patchset so they can be carried forward again by the next patchset.
+		unlock := s.changes.Lock(changeNumber)
+		copied := s.AddVerificationRun(eventInfo.Change.Project, changeNumber, patchset, run.Pipelines)
+		for _, pipeline := range run.Pipelines {
+			build, ok := builds[pipeline]
+			if !ok {
+				continue
+			}
+			id := carriedForwardID(changeNumber, patchset, pipeline)
+			s.AddCommit(id, Commit{
+				Sha1:         eventInfo.PatchSet.Revision,
+				ChangeId:     eventInfo.Change.ID,
+				ChangeNumber: changeNumber,
+				Patchset:     patchset,
+				Project:      eventInfo.Change.Project,
+				Pipeline:     pipeline,
+				Run:          copied,
+			})
+			s.SetBuildResult(id, build.State, build.WebURL)
+		}
+		unlock()
+
+		s.review(changeNumber, patchset, Review{
+			Message: message,
+			Labels:  labels,
+		})
+	case CarryForwardKeep:
+		// Vote with the old result first, then build without resetting the vote.
+		s.review(changeNumber, patchset, Review{
+			Message: message + "\n\nBuilding anyways, the vote will be updated once the build finishes.",
+			Notify:  "NONE",
+			Labels:  labels,
+		})
+		s.triggerBuild(eventInfo, client, BuildOptions{KeepVote: true})
+	}
+}
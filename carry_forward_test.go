@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+// Puts a fake ssh on the PATH which records the arguments of every gerrit command it is asked to run.
+func fakeSSH(t *testing.T) func() [][]string {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "ssh.log")
+	script := "#!/bin/sh\nfor arg in \"$@\"; do printf '%s\\037' \"$arg\"; done >> " + log + "\nprintf '\\036' >> " + log + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "ssh"), []byte(script), 0755); err != nil {
+		t.Fatalf("failed in setup: %s", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return func() [][]string {
+		data, err := os.ReadFile(log)
+		if err != nil {
+			return nil
+		}
+		var calls [][]string
+		for _, call := range strings.Split(strings.TrimSuffix(string(data), "\036"), "\036") {
+			calls = append(calls, strings.Split(strings.TrimSuffix(call, "\037"), "\037"))
+		}
+		os.Remove(log)
+		return calls
+	}
+}
+
+// Returns the value following flag in a recorded ssh command line.
+func sshFlag(call []string, flag string) string {
+	if i := slices.Index(call, flag); i >= 0 && i+1 < len(call) {
+		return call[i+1]
+	}
+	return ""
+}
+
+func TestCarryForward(t *testing.T) {
+	calls := fakeSSH(t)
+
+	var created int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		created++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      "def-456",
+			"number":  7,
+			"web_url": "https://buildkite.com/def-456",
+		})
+	}))
+	defer server.Close()
+	client := buildkite.NewClient(server.Client())
+	baseURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatalf("failed in setup: %s", err)
+	}
+	client.BaseURL = baseURL
+
+	type testCase struct {
+		mode     string
+		builds   int
+		messages []string
+		labels   []string
+	}
+
+	carried := "Build Failed on patchset 1, carried forward since patchset 2 is a TRIVIAL_REBASE.\n\n * ci: failed https://buildkite.com/abc-123"
+	testCases := []testCase{
+		// Copying votes once and records the result on the new patchset.
+		{
+			mode:     "copy",
+			builds:   0,
+			messages: []string{gerritQuote(carried)},
+			labels:   []string{"Verified=-1"},
+		},
+		// Keeping votes with the old result, then builds without resetting the vote.
+		{
+			mode:   "keep",
+			builds: 1,
+			messages: []string{
+				gerritQuote(carried + "\n\nBuilding anyways, the vote will be updated once the build finishes."),
+				gerritQuote("Build Started: https://buildkite.com/def-456"),
+			},
+			labels: []string{"Verified=-1", ""},
+		},
+	}
+
+	for id, tc := range testCases {
+		state := setupTestState(t)
+
+		config, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {"carry_forward_kinds": ["TRIVIAL_REBASE"], "carry_forward_mode": "`+tc.mode+`"}}}`))
+		if err != nil {
+			t.Fatalf("failed to load config: %s", err)
+		}
+		state.Project = "frc971"
+		state.BuildkiteProject = "ci"
+		state.Config = config
+
+		run := state.AddVerificationRun("frc971", 1234, 1, state.verifyPipelines("frc971"))
+		state.AddCommit("abc-123", Commit{ChangeNumber: 1234, Patchset: 1, Project: "frc971", Pipeline: "ci", Run: run})
+		state.SetBuildResult("abc-123", "failed", "https://buildkite.com/abc-123")
+
+		created = 0
+		state.handlePatchsetCreated(EventInfo{
+			Project:  "frc971",
+			Change:   &Change{ID: "I1234", Project: "frc971", Number: 1234},
+			PatchSet: &PatchSet{Number: 2, Revision: "cafe", Kind: "TRIVIAL_REBASE"},
+			Uploader: &User{Name: "Austin", Email: "austin@example.com", Username: "austin"},
+		}, client)
+
+		reviews := calls()
+		if len(reviews) != len(tc.messages) || created != tc.builds {
+			t.Fatalf("expected %d reviews and %d builds for case %d but got %d and %d", len(tc.messages), tc.builds, id, len(reviews), created)
+		}
+		for i, review := range reviews {
+			if review[len(review)-1] != "1234,2" || sshFlag(review, "-m") != tc.messages[i] || sshFlag(review, "--label") != tc.labels[i] {
+				t.Fatalf("unexpected review %d for case %d: %q", i, id, review)
+			}
+		}
+
+		if tc.mode == "copy" {
+			copied, ok := state.GetLatestPatchsetRun(1234, 2)
+			if !ok || state.GetRunBuilds(copied.ID)["ci"].State != "failed" {
+				t.Fatalf("expected the result to be copied for case %d", id)
+			}
+		}
+	}
+}
+
+func TestCarryForwardRun(t *testing.T) {
+	state := setupTestState(t)
+
+	config, err := LoadConfig(writeConfig(t, `{"projects": {
+		"frc971": {"verify_pipelines": ["linux", "docs"], "carry_forward_kinds": ["TRIVIAL_REBASE"]},
+		"other": {"verify_pipelines": ["linux", "lint"], "carry_forward_kinds": ["TRIVIAL_REBASE"], "pipelines": {"lint": {"voting": false}}}
+	}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+
+	var reviews []ReviewInput
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input ReviewInput
+		json.NewDecoder(r.Body).Decode(&input)
+		reviews = append(reviews, input)
+	}))
+	defer server.Close()
+	state.Project = "frc971"
+	state.Config = config
+	state.REST = NewGerritREST(server.URL, "buildkite", "secret")
+	state.ReviewTransport = ReviewOverREST
+
+	type build struct {
+		id       string
+		pipeline string
+		state    string
+	}
+	type testCase struct {
+		project     string
+		change      int
+		builds      []build
+		expectation int
+		message     string
+	}
+
+	// Builds finish in the order listed, so the last one isn't the result of the run.
+	testCases := []testCase{
+		{
+			project: "frc971",
+			change:  1234,
+			builds:  []build{{"linux", "linux", "failed"}, {"docs", "docs", "passed"}},
+			// The failure decides the vote even though docs passed later.
+			expectation: -1,
+			message: "Build Failed on patchset 1, carried forward since patchset 2 is a TRIVIAL_REBASE.\n\n" +
+				" * linux: failed https://buildkite.com/linux\n * docs: passed https://buildkite.com/docs",
+		},
+		{
+			project: "other",
+			change:  1235,
+			builds:  []build{{"linux-2", "linux", "passed"}, {"lint", "lint", "failed"}},
+			// Non-voting pipelines don't change the result.
+			expectation: 1,
+			message: "Build Succeeded on patchset 1, carried forward since patchset 2 is a TRIVIAL_REBASE.\n\n" +
+				" * linux: passed https://buildkite.com/linux-2\n * lint (non-voting): failed https://buildkite.com/lint",
+		},
+	}
+
+	for id, tc := range testCases {
+		run := state.AddVerificationRun(tc.project, tc.change, 1, state.verifyPipelines(tc.project))
+		for _, b := range tc.builds {
+			state.AddCommit(b.id, Commit{ChangeNumber: tc.change, Patchset: 1, Project: tc.project, Pipeline: b.pipeline, Run: run})
+			state.SetBuildResult(b.id, b.state, "https://buildkite.com/"+b.id)
+		}
+
+		// Carried forward twice, the second time from the copied run.
+		for patchset := 2; patchset <= 3; patchset++ {
+			reviews = nil
+			state.handlePatchsetCreated(EventInfo{
+				Project:  tc.project,
+				Change:   &Change{Project: tc.project, Number: tc.change},
+				PatchSet: &PatchSet{Number: patchset, Kind: "TRIVIAL_REBASE"},
+			}, nil)
+			if len(reviews) != 1 || reviews[0].Labels["Verified"] != tc.expectation {
+				t.Fatalf("expected %d on patchset %d for case %d but got %#v", tc.expectation, patchset, id, reviews)
+			}
+			if patchset == 2 && reviews[0].Message != tc.message {
+				t.Fatalf("unexpected message for case %d: %q", id, reviews[0].Message)
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+// Locks serializing the handling of one change or gate queue, so slow work for one doesn't hold up the rest.
+
+import (
+	"sync"
+)
+
+type keyLock struct {
+	mu sync.Mutex
+	// Holders and waiters, so the lock can be dropped once nobody needs it.
+	refs int
+}
+
+// Locks keyed by a change number or gate queue.  The zero value is ready to use.
+type Locks[K comparable] struct {
+	mu    sync.Mutex
+	locks map[K]*keyLock
+}
+
+// Per change locks.
+type ChangeLocks = Locks[int]
+
+// Locks a key, returning the function which unlocks it.
+func (c *Locks[K]) Lock(key K) func() {
+	c.mu.Lock()
+	if c.locks == nil {
+		c.locks = map[K]*keyLock{}
+	}
+	l, ok := c.locks[key]
+	if !ok {
+		l = &keyLock{}
+		c.locks[key] = l
+	}
+	l.refs++
+	c.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		c.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(c.locks, key)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Returns the number of keys locked or waited on.
+func (c *Locks[K]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.locks)
+}
@@ -0,0 +1,87 @@
+package main
+
+// Policies for work in progress and private changes.
+
+import (
+	"log"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+// Returns why automatic builds of a change are skipped, or "" if it should be built.
+func (s *State) skipReason(change *Change) string {
+	config := s.projectConfig(change.Project)
+	if change.Wip && config.WipPolicy == PolicySkip {
+		return "work in progress"
+	}
+	if change.Private && config.PrivatePolicy == PolicySkip {
+		return "private"
+	}
+	return ""
+}
+
+// Returns the pipeline a change has to be built in regardless of what was requested, or "" if any pipeline will do.
+func (s *State) restrictedPipeline(change *Change) string {
+	config := s.projectConfig(change.Project)
+	if change.Private && config.PrivatePolicy == PolicyRestricted {
+		return config.PrivatePipeline
+	}
+	return ""
+}
+
+// Handles wip-state-changed and private-state-changed events, building changes which were skipped while they were drafts.
+func (s *State) handleDraftStateChanged(eventInfo EventInfo, client *buildkite.Client) {
+	if !s.watchesProject(eventInfo.Project) || eventInfo.Change == nil || eventInfo.PatchSet == nil {
+		return
+	}
+
+	if reason := s.skipReason(eventInfo.Change); reason != "" {
+		log.Printf("Change %d is still %s, not building", eventInfo.Change.Number, reason)
+		return
+	}
+
+	// Only build if we skipped the patchset while it was a draft.
+	if _, _, ok := s.GetLatestPatchsetBuild(eventInfo.Change.Number, eventInfo.PatchSet.Number); ok {
+		log.Printf("Change %d,%d was already built", eventInfo.Change.Number, eventInfo.PatchSet.Number)
+		return
+	}
+
+	// These events come from whoever changed the state, build as the uploader of the patchset.
+	eventInfo.Author = nil
+	eventInfo.Uploader = &eventInfo.PatchSet.Uploader
+	if !s.authorizedUser(eventInfo) {
+		return
+	}
+
+	log.Printf("Change %d is ready, building %d,%d", eventInfo.Change.Number, eventInfo.Change.Number, eventInfo.PatchSet.Number)
+	s.handlePatchsetCreated(eventInfo, client)
+}
+
+// Handles change-abandoned, change-merged and change-deleted events by canceling the builds still running for the change.
+func (s *State) handleChangeClosed(eventInfo EventInfo, client *buildkite.Client) {
+	if !s.watchesProject(eventInfo.Project) || eventInfo.Change == nil {
+		return
+	}
+	log.Printf("Change %d closed with %s, canceling its builds", eventInfo.Change.Number, eventInfo.Type)
+	s.cancelChangeBuilds(client, eventInfo.Change.Number)
+}
+
+// Handles a change-restored event, building the current patchset if the project asks for it.
+func (s *State) handleChangeRestored(eventInfo EventInfo, client *buildkite.Client) {
+	if !s.watchesProject(eventInfo.Project) || eventInfo.Change == nil || eventInfo.PatchSet == nil {
+		return
+	}
+	if !s.projectConfig(eventInfo.Project).BuildOnRestore {
+		return
+	}
+
+	// Build as the uploader of the patchset, not whoever restored it.
+	eventInfo.Author = nil
+	eventInfo.Uploader = &eventInfo.PatchSet.Uploader
+	if !s.authorizedUser(eventInfo) {
+		return
+	}
+
+	log.Printf("Change %d restored, building %d,%d", eventInfo.Change.Number, eventInfo.Change.Number, eventInfo.PatchSet.Number)
+	s.handlePatchsetCreated(eventInfo, client)
+}
@@ -0,0 +1,301 @@
+package main
+
+// Parsing and dispatch of the commands reviewers can leave in gerrit comments.
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+type CommandType int
+
+const (
+	// Trigger a new build of the patchset.
+	CommandRetest CommandType = iota
+	// Retry only the jobs which failed in the latest build of the patchset.
+	CommandRetryFailed
+	// Cancel the running builds of the change.
+	CommandCancel
+	// Trigger a new build of the patchset from a clean checkout.
+	CommandRebuildClean
+	// Reply with the list of commands.
+	CommandHelp
+	// Propose a revert of the merged change.
+	CommandRevert
+)
+
+type Command struct {
+	Type CommandType
+	// Pipeline requested with "retest <pipeline>", empty for the default pipeline.
+	Pipeline string
+}
+
+// A line which starts like a command but isn't one we understand.
+type UnknownCommand struct {
+	Line   string
+	Reason string
+}
+
+const commandHelp = `Commands understood by the CI bridge, each on a line of its own:
+  retest              Trigger a new build of this patchset.
+  retest <pipeline>   Trigger a new build of this patchset in the named pipeline.
+  retry-failed        Retry the failed jobs of the latest builds.
+  cancel              Cancel the running builds of this change.
+  rebuild clean       Trigger a new build from a clean checkout.
+  ci revert           Propose a revert of this merged change for breaking the build.
+  ci help             Show this message.`
+
+// Words which start a command line.  Any other line in a comment is ordinary review text.
+var commandWords = []string{"retest", "retry-failed", "cancel", "rebuild", "ci"}
+
+// Words of a line which could be a mistyped command, rather than a sentence.
+var commandLikeWord = regexp.MustCompile(`^[a-z0-9][a-z0-9._/-]*$`)
+
+// Returns true if a line which didn't parse still looks like an attempt at a command: a command word and at most one
+// more plain word.  Sentences which happen to start with a command word, like "cancel that, it was fine", don't.
+func looksLikeCommand(fields []string) bool {
+	if len(fields) > 2 {
+		return false
+	}
+	for _, field := range fields {
+		if !commandLikeWord.MatchString(field) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses all the commands in a gerrit comment.  Commands must be on a line of their own.
+// Lines which start with a command word and look like a command but don't parse are returned as unknown so they can
+// be reported back.
+func ParseCommands(comment string) ([]Command, []UnknownCommand) {
+	var commands []Command
+	var unknown []UnknownCommand
+
+	for _, line := range strings.Split(comment, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !slices.Contains(commandWords, fields[0]) {
+			continue
+		}
+		line = strings.Join(fields, " ")
+
+		var command Command
+		switch {
+		case fields[0] == "retest" && len(fields) <= 2:
+			command.Type = CommandRetest
+			if len(fields) == 2 {
+				command.Pipeline = fields[1]
+			}
+		case fields[0] == "retry-failed" && len(fields) == 1:
+			command.Type = CommandRetryFailed
+		case fields[0] == "cancel" && len(fields) == 1:
+			command.Type = CommandCancel
+		case line == "rebuild clean":
+			command.Type = CommandRebuildClean
+		case line == "ci help":
+			command.Type = CommandHelp
+		case line == "ci revert":
+			command.Type = CommandRevert
+		default:
+			if looksLikeCommand(fields) {
+				unknown = append(unknown, UnknownCommand{
+					Line:   line,
+					Reason: "unknown command",
+				})
+			}
+			continue
+		}
+
+		// Asking for the same thing twice in one comment shouldn't do it twice.
+		if !slices.Contains(commands, command) {
+			commands = append(commands, command)
+		}
+	}
+
+	return commands, unknown
+}
+
+// Returns true if the event was generated by the bridge itself.
+func (s *State) isOwnEvent(eventInfo EventInfo) bool {
+	return eventInfo.Author != nil && eventInfo.Author.Username == s.User
+}
+
+// Returns true if builds may be requested in the provided pipeline.
+func (s *State) allowedPipeline(pipeline string) bool {
+	return pipeline == s.BuildkiteProject || slices.Contains(s.RetestPipelines, pipeline)
+}
+
+// Handles a comment-added event, running any commands found in the comment.
+func (s *State) handleComment(eventInfo EventInfo, client *buildkite.Client) {
+	if !s.watchesProject(eventInfo.Project) {
+		return
+	}
+
+	// Never interpret our own replies, they quote the commands.
+	if s.isOwnEvent(eventInfo) {
+		return
+	}
+
+	if eventInfo.Change == nil || eventInfo.PatchSet == nil {
+		log.Println("Failed to find Change")
+		return
+	}
+
+	commands, unknown := ParseCommands(eventInfo.Comment)
+	if len(commands) == 0 && len(unknown) == 0 {
+		return
+	}
+
+	if !s.authorizedUser(eventInfo) {
+		return
+	}
+
+	// Acknowledge everything up front so the reply shows up before any build links.
+	var reply []string
+	for _, command := range commands {
+		reply = append(reply, s.acknowledgeCommand(eventInfo, command))
+	}
+	for _, u := range unknown {
+		reply = append(reply, fmt.Sprintf("%s: %s, reply 'ci help' for the list of commands.", u.Line, u.Reason))
+	}
+
+	// The reply is only for whoever asked, unknown commands included.
+	s.review(eventInfo.Change.Number, eventInfo.PatchSet.Number, Review{
+		Message: strings.Join(reply, "\n\n"),
+		Notify:  "NONE",
+	})
+
+	for _, command := range commands {
+		s.runCommand(eventInfo, client, command)
+	}
+}
+
+// Returns the reply acknowledging a command.
+func (s *State) acknowledgeCommand(eventInfo EventInfo, command Command) string {
+	switch command.Type {
+	case CommandRetest:
+		if command.Pipeline == "" {
+			return fmt.Sprintf("retest: building patchset %d.", eventInfo.PatchSet.Number)
+		}
+		if !s.allowedPipeline(command.Pipeline) {
+			return fmt.Sprintf("retest %s: unknown pipeline, allowed pipelines are: %s.",
+				command.Pipeline, strings.Join(append([]string{s.BuildkiteProject}, s.RetestPipelines...), ", "))
+		}
+		return fmt.Sprintf("retest %s: building patchset %d in %s.", command.Pipeline, eventInfo.PatchSet.Number, command.Pipeline)
+	case CommandRetryFailed:
+		return fmt.Sprintf("retry-failed: retrying the failed jobs of the latest builds of patchset %d.", eventInfo.PatchSet.Number)
+	case CommandCancel:
+		return fmt.Sprintf("cancel: canceling the running builds of change %d.", eventInfo.Change.Number)
+	case CommandRebuildClean:
+		return fmt.Sprintf("rebuild clean: building patchset %d from a clean checkout.", eventInfo.PatchSet.Number)
+	case CommandHelp:
+		return commandHelp
+	case CommandRevert:
+		if eventInfo.Change.Status != "MERGED" {
+			return "ci revert: only merged changes can be reverted."
+		}
+		if !s.projectConfig(eventInfo.Project).AutoRevert {
+			return "ci revert: reverts aren't enabled for this project."
+		}
+		return "ci revert: proposing a revert of this change."
+	}
+	return ""
+}
+
+// Runs an acknowledged command.
+func (s *State) runCommand(eventInfo EventInfo, client *buildkite.Client, command Command) {
+	switch command.Type {
+	case CommandRetest:
+		if command.Pipeline == "" {
+			s.triggerBuild(eventInfo, client, BuildOptions{Requested: true})
+		} else if s.allowedPipeline(command.Pipeline) {
+			s.triggerBuild(eventInfo, client, BuildOptions{Pipeline: command.Pipeline, Requested: true})
+		}
+	case CommandRetryFailed:
+		s.retryFailedJobs(eventInfo, client)
+	case CommandCancel:
+		s.cancelChangeBuilds(client, eventInfo.Change.Number)
+	case CommandRebuildClean:
+		s.triggerBuild(eventInfo, client, BuildOptions{
+			Env: map[string]string{
+				"BUILDKITE_CLEAN_CHECKOUT": "true",
+			},
+			Requested: true,
+		})
+	case CommandHelp:
+	case CommandRevert:
+		if eventInfo.Change.Status != "MERGED" {
+			return
+		}
+		commenter := "an operator"
+		if eventInfo.Author != nil {
+			commenter = eventInfo.Author.Name
+		}
+		s.proposeRevert(eventInfo.Project, MergedChange{
+			Number:   eventInfo.Change.Number,
+			Patchset: eventInfo.PatchSet.Number,
+			ChangeId: eventInfo.Change.ID,
+			Subject:  eventInfo.Change.Subject,
+			URL:      eventInfo.Change.URL,
+			Revision: eventInfo.PatchSet.Revision,
+		}, fmt.Sprintf("%s identified this change as breaking the build.", commenter))
+	}
+}
+
+// Returns true if a comment-added event voted the project's trigger label, and didn't already ask for a build with a command.
+func (s *State) triggerLabelVoted(eventInfo EventInfo) bool {
+	trigger := s.projectConfig(eventInfo.Project).TriggerLabel
+	if trigger == nil || !approvalReached(eventInfo.Approvals, trigger.Label, trigger.Value) {
+		return false
+	}
+	commands, _ := ParseCommands(eventInfo.Comment)
+	for _, command := range commands {
+		if command.Type == CommandRetest || command.Type == CommandRebuildClean {
+			log.Printf("%s on %d came with a build command, not building twice", trigger.Label, eventInfo.Change.Number)
+			return false
+		}
+	}
+	return true
+}
+
+// Handles a comment-added event, building the patchset if a reviewer just voted the project's trigger label.
+func (s *State) handleTriggerLabel(eventInfo EventInfo, client *buildkite.Client) {
+	if !s.watchesProject(eventInfo.Project) || eventInfo.Change == nil || eventInfo.PatchSet == nil || s.isOwnEvent(eventInfo) {
+		return
+	}
+	if !s.triggerLabelVoted(eventInfo) || !s.authorizedUser(eventInfo) {
+		return
+	}
+
+	trigger := s.projectConfig(eventInfo.Project).TriggerLabel
+	log.Printf("%s=%s on %d,%d, building", trigger.Label, trigger.Value, eventInfo.Change.Number, eventInfo.PatchSet.Number)
+	s.triggerBuild(eventInfo, client, BuildOptions{Requested: true})
+
+	if trigger.Reset {
+		s.resetTriggerLabel(eventInfo, trigger.Label)
+	}
+}
+
+// Deletes the trigger label vote of the reviewer in a comment-added event, so they can vote it again to ask for another build.
+// Votes belong to the account which cast them, so this needs the REST API rather than voting 0 ourselves.
+func (s *State) resetTriggerLabel(eventInfo EventInfo, label string) {
+	if eventInfo.Author == nil {
+		return
+	}
+	account := eventInfo.Author.Username
+	if account == "" {
+		account = eventInfo.Author.Email
+	}
+	if s.REST == nil || account == "" {
+		log.Printf("Can't delete the %s vote of %s on %d", label, eventInfo.Author.Name, eventInfo.Change.Number)
+		return
+	}
+	if err := s.REST.DeleteVote(eventInfo.Change.Number, account, label); err != nil {
+		log.Printf("Failed to delete the %s vote of %s on %d: %v", label, account, eventInfo.Change.Number, err)
+	}
+}
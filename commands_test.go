@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseCommands(t *testing.T) {
+	type testCase struct {
+		comment  string
+		commands []Command
+		unknown  []UnknownCommand
+	}
+
+	testCases := []testCase{
+		// Plain review text isn't a command
+		{
+			comment: "Patch Set 2: Code-Review+1\n\nLooks good, please retest after lunch",
+		},
+		// The classic retest
+		{
+			comment:  "Patch Set 2:\n\nretest",
+			commands: []Command{{Type: CommandRetest}},
+		},
+		// Surrounding whitespace is ignored
+		{
+			comment:  "Patch Set 2:\n\n  retest  \n",
+			commands: []Command{{Type: CommandRetest}},
+		},
+		// Retest in a specific pipeline
+		{
+			comment:  "Patch Set 2:\n\nretest docs",
+			commands: []Command{{Type: CommandRetest, Pipeline: "docs"}},
+		},
+		{
+			comment:  "retry-failed",
+			commands: []Command{{Type: CommandRetryFailed}},
+		},
+		{
+			comment:  "cancel",
+			commands: []Command{{Type: CommandCancel}},
+		},
+		{
+			comment:  "rebuild   clean",
+			commands: []Command{{Type: CommandRebuildClean}},
+		},
+		{
+			comment:  "ci help",
+			commands: []Command{{Type: CommandHelp}},
+		},
+		{
+			comment:  "ci revert",
+			commands: []Command{{Type: CommandRevert}},
+		},
+		// Several commands in one comment, duplicates collapsed
+		{
+			comment:  "cancel\nretest\nretest\nretest docs",
+			commands: []Command{{Type: CommandCancel}, {Type: CommandRetest}, {Type: CommandRetest, Pipeline: "docs"}},
+		},
+		// Commands are case sensitive, like the old retest regex
+		{
+			comment: "Retest\nCancel that, it was fine",
+		},
+		// Things which look like commands but aren't
+		{
+			comment: "rebuild dirty\nci status\nretry-failed please",
+			unknown: []UnknownCommand{
+				{Line: "rebuild dirty", Reason: "unknown command"},
+				{Line: "ci status", Reason: "unknown command"},
+				{Line: "retry-failed please", Reason: "unknown command"},
+			},
+		},
+		// Sentences which start with a command word are review text
+		{
+			comment: "cancel that, it was fine\nrebuild the index first\nretest docs linux",
+		},
+		// Known and unknown commands mixed
+		{
+			comment:  "retest\nci\n",
+			commands: []Command{{Type: CommandRetest}},
+			unknown:  []UnknownCommand{{Line: "ci", Reason: "unknown command"}},
+		},
+	}
+
+	for id, tc := range testCases {
+		commands, unknown := ParseCommands(tc.comment)
+		if !reflect.DeepEqual(commands, tc.commands) {
+			t.Errorf("expected commands %#v for case %d but got %#v", tc.commands, id, commands)
+		}
+		if !reflect.DeepEqual(unknown, tc.unknown) {
+			t.Errorf("expected unknown %#v for case %d but got %#v", tc.unknown, id, unknown)
+		}
+	}
+}
+
+func TestOwnCommentsIgnored(t *testing.T) {
+	state := &State{User: "buildkite"}
+
+	// Our help reply quotes every command, it must never be run.
+	if !state.isOwnEvent(EventInfo{Author: &User{Username: "buildkite"}, Comment: commandHelp}) {
+		t.Fatalf("expected our own comment to be detected")
+	}
+	if state.isOwnEvent(EventInfo{Author: &User{Username: "AustinSchuh"}, Comment: "retest"}) {
+		t.Fatalf("expected a reviewer comment to not be ours")
+	}
+}
+
+func TestTriggerLabelVoted(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {"trigger_label": {"label": "Run-CI", "reset": true}}}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	state := &State{Project: "frc971", Config: config}
+
+	type testCase struct {
+		project     string
+		approvals   []Approval
+		comment     string
+		expectation bool
+	}
+
+	testCases := []testCase{
+		{
+			project:     "frc971",
+			approvals:   []Approval{{Type: "Run-CI", Value: "1", OldValue: "0"}},
+			expectation: true,
+		},
+		// Gerrit repeats current votes on every comment
+		{
+			project:     "frc971",
+			approvals:   []Approval{{Type: "Run-CI", Value: "1"}},
+			expectation: false,
+		},
+		// The vote being deleted
+		{
+			project:     "frc971",
+			approvals:   []Approval{{Type: "Run-CI", Value: "0", OldValue: "1"}},
+			expectation: false,
+		},
+		// The retest already builds it
+		{
+			project:     "frc971",
+			approvals:   []Approval{{Type: "Run-CI", Value: "1", OldValue: "0"}},
+			comment:     "Patch Set 1: Run-CI+1\n\nretest",
+			expectation: false,
+		},
+		{
+			project:     "other",
+			approvals:   []Approval{{Type: "Run-CI", Value: "1", OldValue: "0"}},
+			expectation: false,
+		},
+	}
+
+	for id, tc := range testCases {
+		eventInfo := EventInfo{Project: tc.project, Change: &Change{Project: tc.project, Number: 1234}, Approvals: tc.approvals, Comment: tc.comment}
+		if voted := state.triggerLabelVoted(eventInfo); voted != tc.expectation {
+			t.Fatalf("expected %v for case %d but got %v", tc.expectation, id, voted)
+		}
+	}
+
+	if _, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {"trigger_label": {"value": "1"}}}}`)); err == nil {
+		t.Fatalf("expected a trigger label without a label to be rejected")
+	}
+	if err := config.ValidateWithoutREST(); err == nil {
+		t.Fatalf("expected reset to need the REST API")
+	}
+}
+
+func TestResetTriggerLabel(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.EscapedPath())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	state := &State{REST: NewGerritREST(server.URL, "buildkite", "secret")}
+
+	change := &Change{Number: 1234}
+	state.resetTriggerLabel(EventInfo{Change: change, Author: &User{Name: "Jane", Username: "jane"}}, "Run-CI")
+	state.resetTriggerLabel(EventInfo{Change: change, Author: &User{Name: "Joe", Email: "joe+ci@example.com"}}, "Run-CI")
+	state.resetTriggerLabel(EventInfo{Change: change, Author: &User{Name: "Nobody"}}, "Run-CI")
+
+	expectation := []string{
+		"DELETE /a/changes/1234/reviewers/jane/votes/Run-CI",
+		"DELETE /a/changes/1234/reviewers/joe+ci@example.com/votes/Run-CI",
+	}
+	if !reflect.DeepEqual(requests, expectation) {
+		t.Fatalf("expected %v but got %v", expectation, requests)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+// Tests of the locking between gerrit events and webhooks, meant to be run with -race.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+func TestPendingBuilds(t *testing.T) {
+	var pending PendingBuilds
+	var records atomic.Int32
+	token := pending.Add(func(build *buildkite.Build) {
+		records.Add(1)
+	})
+
+	var wg sync.WaitGroup
+	var recorded atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := "build"
+			if pending.Record(token, &buildkite.Build{ID: &id}) {
+				recorded.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if records.Load() != 1 || recorded.Load() != 1 {
+		t.Fatalf("expected the build to be recorded once but got %d records, %d recorded", records.Load(), recorded.Load())
+	}
+	if pending.Record("unknown", nil) {
+		t.Fatalf("expected unknown tokens to be ignored")
+	}
+	pending.Remove(token)
+	if pending.Record(token, nil) {
+		t.Fatalf("expected removed tokens to be ignored")
+	}
+	if other := pending.Add(func(build *buildkite.Build) {}); other == token || len(other) != 32 {
+		t.Fatalf("unexpected token %q", other)
+	}
+}
+
+func TestChangeLocks(t *testing.T) {
+	var locks ChangeLocks
+	counts := map[int]int{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(change int) {
+			defer wg.Done()
+			unlock := locks.Lock(change)
+			// Only safe because the change is locked.
+			counts[change]++
+			unlock()
+		}(i % 2)
+	}
+	wg.Wait()
+	if counts[0] != 50 || counts[1] != 50 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+
+	// A locked change doesn't hold up other changes.
+	unlock := locks.Lock(1234)
+	done := make(chan bool)
+	go func() {
+		locks.Lock(5678)()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("locking another change blocked")
+	}
+	unlock()
+
+	if n := locks.len(); n != 0 {
+		t.Fatalf("expected unused locks to be dropped but %d remain", n)
+	}
+}
+
+// Webhooks for builds of several changes finish before Buildkite answers the creates.
+func TestWebhooksBeforeCreate(t *testing.T) {
+	state := setupTestState(t)
+	state.DB.SetMaxOpenConns(1)
+
+	var mu sync.Mutex
+	reviews := map[string]ReviewInput{}
+	reviewed := make(chan bool, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/a/changes/") {
+			var input ReviewInput
+			json.NewDecoder(r.Body).Decode(&input)
+			mu.Lock()
+			reviews[r.URL.Path] = input
+			mu.Unlock()
+			reviewed <- true
+			return
+		}
+
+		var create buildkite.CreateBuild
+		json.NewDecoder(r.Body).Decode(&create)
+		id := "build-" + create.Commit
+		build := Build{ID: id, Number: 1, State: "passed", WebURL: "https://buildkite.com/" + id, MetaData: create.MetaData}
+		body, _ := json.Marshal(BuildkiteWebhook{Event: "build.finished", Build: build})
+
+		webhook := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		webhook.Header.Set("X-Buildkite-Token", "secret")
+		state.handle(httptest.NewRecorder(), webhook)
+		// Wait for the webhook to record the build, as if Buildkite was slow to answer.
+		for i := 0; ; i++ {
+			if _, ok := state.GetCommit(id); ok {
+				break
+			}
+			if i == 500 {
+				t.Errorf("webhook for %s didn't record it", id)
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "number": 1, "web_url": build.WebURL})
+	}))
+	defer server.Close()
+
+	state.Project = "frc971"
+	state.Token = "secret"
+	state.BuildkiteOrganization = "org"
+	state.REST = NewGerritREST(server.URL, "buildkite", "secret")
+	state.ReviewTransport = ReviewOverREST
+	client := testBuildkiteClient(t, server)
+
+	const changes = 8
+	var records atomic.Int32
+	var wg sync.WaitGroup
+	for change := 1; change <= changes; change++ {
+		wg.Add(1)
+		go func(change int) {
+			defer wg.Done()
+			state.createBuild(client, "ci", &buildkite.CreateBuild{Commit: fmt.Sprintf("%d", change)}, func(build *buildkite.Build) {
+				records.Add(1)
+				state.AddCommit(*build.ID, Commit{ChangeNumber: change, Patchset: 1, Project: "frc971", Pipeline: "ci", Number: *build.Number})
+			})
+		}(change)
+	}
+	wg.Wait()
+
+	for i := 0; i < changes; i++ {
+		select {
+		case <-reviewed:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only %d of %d results were posted", i, changes)
+		}
+	}
+	if records.Load() != changes {
+		t.Fatalf("expected each build to be recorded once but got %d records", records.Load())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for change := 1; change <= changes; change++ {
+		review := reviews[fmt.Sprintf("/a/changes/%d/revisions/1/review", change)]
+		if review.Labels["Verified"] != 1 || review.Message != fmt.Sprintf("Build Succeeded: https://buildkite.com/build-%d", change) {
+			t.Fatalf("unexpected review of %d: %#v", change, review)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+// Per project configuration, loaded from the JSON file passed with --config.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+type Config struct {
+	// Configuration for each gerrit project, keyed by project name.
+	Projects map[string]*ProjectConfig `json:"projects"`
+}
+
+type ProjectConfig struct {
+	// Patchset kinds, as reported by gerrit, which carry the Verified result of the previous patchset forward.  Eg; NO_CODE_CHANGE or TRIVIAL_REBASE.
+	CarryForwardKinds []string `json:"carry_forward_kinds,omitempty"`
+	// How to carry the result forward.  "copy" copies the previous result onto the new patchset instead of building it.
+	// "keep" copies the previous vote onto the new patchset, and builds it anyways to replace the vote once the new result lands.
+	CarryForwardMode string `json:"carry_forward_mode,omitempty"`
+
+	// What to do with work in progress changes, "build" or "skip".  Skipped changes are built once they are marked ready for review.
+	WipPolicy string `json:"wip_policy,omitempty"`
+	// What to do with private changes, "build", "skip", or "restricted" to build them in PrivatePipeline.
+	// Skipped changes are built once they are made public.
+	PrivatePolicy string `json:"private_policy,omitempty"`
+	// Buildkite pipeline private changes are built in with the "restricted" policy.
+	PrivatePipeline string `json:"private_pipeline,omitempty"`
+
+	// Pass the chain of open changes a change sits on to its builds.
+	BuildChains bool `json:"build_chains,omitempty"`
+	// Rebuild the open changes stacked on a change when it gets a new patchset.
+	RebuildDescendants bool `json:"rebuild_descendants,omitempty"`
+
+	// Build the current patchset of abandoned changes when they are restored.
+	BuildOnRestore bool `json:"build_on_restore,omitempty"`
+
+	// text/template for the Buildkite branch of change builds, defaults to the Change-Id.  See BuildTemplateData for the fields.
+	BranchTemplate string `json:"branch_template,omitempty"`
+	// text/template for the Buildkite message of change builds, defaults to Buildkite's own.
+	MessageTemplate string `json:"message_template,omitempty"`
+
+	branchTemplate  *template.Template
+	messageTemplate *template.Template
+
+	// text/templates for the review messages posted as builds start and finish, keyed by "started", "passed", "failed",
+	// "canceled", "blocked", "skipped" or "infra_failed".  See MessageTemplateData for the fields.  Events which aren't set
+	// use the default messages.
+	Messages map[string]string `json:"messages,omitempty"`
+
+	messages map[string]*template.Template
+
+	// Buildkite pipelines every patchset is built in, defaults to --buildkite_project.  The vote is combined from all of them.
+	VerifyPipelines []string `json:"verify_pipelines,omitempty"`
+	// How builds vote, keyed by Buildkite pipeline.  Pipelines which aren't listed vote Verified +1 when they pass and -1 otherwise.
+	Pipelines map[string]*PipelineConfig `json:"pipelines,omitempty"`
+
+	// Build all the open changes sharing a topic, in any project, together in one build and report the result on all of them.
+	TopicBuilds bool `json:"topic_builds,omitempty"`
+
+	// Let authors control builds with CI-Skip, CI-Pipelines and CI-Env trailers in their commit messages, nil to ignore them.
+	CITrailers *CITrailersConfig `json:"ci_trailers,omitempty"`
+
+	// Hashtags which change how a change is built, keyed by hashtag.
+	Hashtags map[string]*HashtagConfig `json:"hashtags,omitempty"`
+
+	// Label reviewers vote to build a patchset, as an alternative to commenting "retest".  nil to only build on comments.
+	TriggerLabel *TriggerLabelConfig `json:"trigger_label,omitempty"`
+
+	// Gate approved changes through a merge queue, nil to leave submission to humans.
+	Gate *GateConfig `json:"gate,omitempty"`
+
+	// Refs to build when they are updated, and the pipelines to build them in.
+	// Defaults to building refs/heads/master and refs/heads/main in --buildkite_project.
+	BranchBuilds []BranchBuildConfig `json:"branch_builds,omitempty"`
+	// Chat webhook, like a Slack incoming webhook, notified when a branch build fails.
+	BranchFailureWebhook string `json:"branch_failure_webhook,omitempty"`
+	// Bisect failed branch builds covering several changes to find the one which broke the build.
+	Bisect bool `json:"bisect,omitempty"`
+
+	// Propose reverts of changes which broke a branch build, through the REST API configured with --gerrit_url.
+	AutoRevert bool `json:"auto_revert,omitempty"`
+	// Only say which changes would be reverted.
+	RevertDryRun bool `json:"revert_dry_run,omitempty"`
+	// Hashtag added to proposed reverts, defaults to "ci-revert".
+	RevertHashtag string `json:"revert_hashtag,omitempty"`
+}
+
+type PipelineConfig struct {
+	// Label builds in the pipeline vote on, defaults to Verified.
+	Label string `json:"label,omitempty"`
+	// False to only post the results of builds in the pipeline, without ever touching a label.  Defaults to true.
+	Voting *bool `json:"voting,omitempty"`
+	// Label value to vote for each final build state, or "none" to leave the label alone.
+	// States which aren't listed vote +1 when passed, leave the label alone when the build didn't run to completion, and -1 otherwise.
+	Votes map[string]string `json:"votes,omitempty"`
+	// Times to retry the jobs of a build which failed because agents were lost, before voting.  Defaults to 1.
+	InfraRetries *int `json:"infra_retries,omitempty"`
+
+	// Globs of the files the pipeline builds, eg; "docs/**" or "**/*.md".  Patchsets are only built if they change a file which
+	// matches an include pattern, or there are none, and no exclude pattern.
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+type CITrailersConfig struct {
+	// Allow CI-Skip to skip automatic builds.  Builds asked for with commands still run.
+	Skip bool `json:"skip,omitempty"`
+	// Pipelines CI-Pipelines can pick.  CI-Pipelines is rejected unless some are listed.
+	Pipelines []string `json:"pipelines,omitempty"`
+	// Environment variables CI-Env can set.
+	Env []string `json:"env,omitempty"`
+}
+
+type HashtagConfig struct {
+	// Pipelines to build changes with the hashtag in instead of verify_pipelines.  Adding the hashtag builds the current patchset in them.
+	Pipelines []string `json:"pipelines,omitempty"`
+	// Don't build changes with the hashtag automatically.  Removing the hashtag builds the patchset it skipped.
+	Skip bool `json:"skip,omitempty"`
+}
+
+type BranchBuildConfig struct {
+	// Pattern matched against the full ref name, eg; "refs/heads/release/*" or "refs/tags/v*".  "*" doesn't match "/".
+	Ref string `json:"ref"`
+	// Buildkite pipeline to build in, defaults to --buildkite_project.
+	Pipeline string `json:"pipeline,omitempty"`
+}
+
+type TriggerLabelConfig struct {
+	// Label and value which build the patchset, the value defaults to 1.
+	Label string `json:"label"`
+	Value string `json:"value,omitempty"`
+	// Delete the vote once the build is scheduled, so it can be voted again.  Needs --gerrit_url.
+	Reset bool `json:"reset,omitempty"`
+}
+
+type GateConfig struct {
+	// Label and value which add a change to the queue, defaults to Code-Review=2.
+	Label string `json:"label,omitempty"`
+	Value string `json:"value,omitempty"`
+	// Buildkite pipeline to run gate builds in, defaults to --buildkite_project.
+	Pipeline string `json:"pipeline,omitempty"`
+}
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Patchset kinds gerrit reports in patchset-created events.
+var patchSetKinds = []string{"REWORK", "TRIVIAL_REBASE", "MERGE_FIRST_PARENT_UPDATE", "NO_CODE_CHANGE", "NO_CHANGE"}
+
+const (
+	CarryForwardCopy = "copy"
+	CarryForwardKeep = "keep"
+)
+
+const (
+	PolicyBuild      = "build"
+	PolicySkip       = "skip"
+	PolicyRestricted = "restricted"
+)
+
+// Loads and validates the configuration file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// Returns an error if the configuration uses features which need the gerrit REST API.
+func (c *Config) ValidateWithoutREST() error {
+	for name, project := range c.Projects {
+		if project.TriggerLabel != nil && project.TriggerLabel.Reset {
+			return fmt.Errorf("project %s: trigger_label reset needs --gerrit_url to delete votes", name)
+		}
+		if project.AutoRevert && !project.RevertDryRun {
+			return fmt.Errorf("project %s: auto_revert needs --gerrit_url to create reverts", name)
+		}
+	}
+	return nil
+}
+
+// Checks the configuration for mistakes, and fills in defaults.
+func (c *Config) Validate() error {
+	for name, project := range c.Projects {
+		if project == nil {
+			return fmt.Errorf("project %s: empty configuration", name)
+		}
+		if err := project.Validate(); err != nil {
+			return fmt.Errorf("project %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (p *ProjectConfig) Validate() error {
+	for _, kind := range p.CarryForwardKinds {
+		if !slices.Contains(patchSetKinds, kind) {
+			return fmt.Errorf("unknown patchset kind %q in carry_forward_kinds", kind)
+		}
+		if kind == "REWORK" {
+			return fmt.Errorf("REWORK patchsets change the code, their result can't be carried forward")
+		}
+	}
+
+	switch p.CarryForwardMode {
+	case "":
+		p.CarryForwardMode = CarryForwardCopy
+	case CarryForwardCopy, CarryForwardKeep:
+	default:
+		return fmt.Errorf("unknown carry_forward_mode %q, expected %q or %q", p.CarryForwardMode, CarryForwardCopy, CarryForwardKeep)
+	}
+
+	switch p.WipPolicy {
+	case "":
+		p.WipPolicy = PolicyBuild
+	case PolicyBuild, PolicySkip:
+	default:
+		return fmt.Errorf("unknown wip_policy %q, expected %q or %q", p.WipPolicy, PolicyBuild, PolicySkip)
+	}
+
+	switch p.PrivatePolicy {
+	case "":
+		p.PrivatePolicy = PolicyBuild
+	case PolicyBuild, PolicySkip:
+	case PolicyRestricted:
+		if p.PrivatePipeline == "" {
+			return fmt.Errorf("private_policy %q needs a private_pipeline", PolicyRestricted)
+		}
+	default:
+		return fmt.Errorf("unknown private_policy %q, expected %q, %q or %q", p.PrivatePolicy, PolicyBuild, PolicySkip, PolicyRestricted)
+	}
+
+	if p.BranchTemplate != "" {
+		t, err := parseBuildTemplate("branch_template", p.BranchTemplate)
+		if err != nil {
+			return fmt.Errorf("branch_template: %w", err)
+		}
+		p.branchTemplate = t
+	}
+	if p.MessageTemplate != "" {
+		t, err := parseBuildTemplate("message_template", p.MessageTemplate)
+		if err != nil {
+			return fmt.Errorf("message_template: %w", err)
+		}
+		p.messageTemplate = t
+	}
+
+	for i, pipeline := range p.VerifyPipelines {
+		if pipeline == "" {
+			return fmt.Errorf("empty pipeline in verify_pipelines")
+		}
+		if slices.Contains(p.VerifyPipelines[:i], pipeline) {
+			return fmt.Errorf("pipeline %s is listed twice in verify_pipelines", pipeline)
+		}
+	}
+
+	for name, pipeline := range p.Pipelines {
+		if pipeline == nil {
+			return fmt.Errorf("pipeline %s: empty configuration", name)
+		}
+		if err := pipeline.Validate(); err != nil {
+			return fmt.Errorf("pipeline %s: %w", name, err)
+		}
+	}
+
+	for name, hashtag := range p.Hashtags {
+		if hashtag == nil || (len(hashtag.Pipelines) == 0 && !hashtag.Skip) {
+			return fmt.Errorf("hashtag %s: needs pipelines or skip", name)
+		}
+		if len(hashtag.Pipelines) > 0 && hashtag.Skip {
+			return fmt.Errorf("hashtag %s: can't both skip and pick pipelines", name)
+		}
+	}
+
+	if p.CITrailers != nil {
+		for _, key := range p.CITrailers.Env {
+			if !envName.MatchString(key) {
+				return fmt.Errorf("ci_trailers env %q isn't an environment variable name", key)
+			}
+		}
+	}
+
+	messages, err := parseMessageTemplates(p.Messages)
+	if err != nil {
+		return fmt.Errorf("messages: %w", err)
+	}
+	p.messages = messages
+
+	for _, branchBuild := range p.BranchBuilds {
+		if !strings.HasPrefix(branchBuild.Ref, "refs/") {
+			return fmt.Errorf("branch_builds ref %q must be a full ref name starting with refs/", branchBuild.Ref)
+		}
+		if _, err := path.Match(branchBuild.Ref, ""); err != nil {
+			return fmt.Errorf("branch_builds ref %q: %w", branchBuild.Ref, err)
+		}
+	}
+
+	if p.RevertHashtag == "" {
+		p.RevertHashtag = "ci-revert"
+	}
+
+	if p.TriggerLabel != nil {
+		if p.TriggerLabel.Label == "" {
+			return fmt.Errorf("trigger_label needs a label")
+		}
+		if p.TriggerLabel.Value == "" {
+			p.TriggerLabel.Value = "1"
+		}
+		if _, err := strconv.Atoi(p.TriggerLabel.Value); err != nil {
+			return fmt.Errorf("trigger_label value %q is not a number", p.TriggerLabel.Value)
+		}
+	}
+
+	if p.Gate != nil {
+		if p.Gate.Label == "" {
+			p.Gate.Label = "Code-Review"
+		}
+		if p.Gate.Value == "" {
+			p.Gate.Value = "2"
+		}
+		if _, err := strconv.Atoi(p.Gate.Value); err != nil {
+			return fmt.Errorf("gate value %q is not a number", p.Gate.Value)
+		}
+	}
+	return nil
+}
+
+func (p *PipelineConfig) Validate() error {
+	if p.Label == "" {
+		p.Label = "Verified"
+	}
+	if p.Voting == nil {
+		voting := true
+		p.Voting = &voting
+	}
+	if p.InfraRetries == nil {
+		retries := 1
+		p.InfraRetries = &retries
+	}
+	if *p.InfraRetries < 0 {
+		return fmt.Errorf("infra_retries can't be negative")
+	}
+	if p.Votes == nil {
+		p.Votes = map[string]string{}
+	}
+	for state, value := range p.Votes {
+		if !slices.Contains(buildStates, state) {
+			return fmt.Errorf("unknown build state %q in votes, expected one of %s", state, strings.Join(buildStates, ", "))
+		}
+		if value == NoVote {
+			continue
+		}
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("vote %q for %s is not a number or %q", value, state, NoVote)
+		}
+	}
+	include, err := compileGlobs(p.Include)
+	if err != nil {
+		return fmt.Errorf("include: %w", err)
+	}
+	p.include = include
+	exclude, err := compileGlobs(p.Exclude)
+	if err != nil {
+		return fmt.Errorf("exclude: %w", err)
+	}
+	p.exclude = exclude
+
+	for _, state := range buildStates {
+		if _, ok := p.Votes[state]; ok {
+			continue
+		}
+		switch {
+		case state == "passed":
+			p.Votes[state] = "+1"
+		case !buildCompleted(state):
+			// The build says nothing about the change, so don't blame it.
+			p.Votes[state] = NoVote
+		default:
+			p.Votes[state] = "-1"
+		}
+	}
+	return nil
+}
+
+// Returns the configuration for a project, or the defaults if it isn't configured.
+func (s *State) projectConfig(project string) *ProjectConfig {
+	if s.Config != nil {
+		if config, ok := s.Config.Projects[project]; ok {
+			return config
+		}
+	}
+	return defaultProjectConfig()
+}
+
+// The configuration of projects which aren't configured, built once and shared.
+var defaultProjectConfig = sync.OnceValue(func() *ProjectConfig {
+	config := &ProjectConfig{}
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid default project configuration: %v", err)
+	}
+	return config
+})
+
+// Returns the configuration for the project of a recorded build, falling back to --project for builds recorded without one.
+func (s *State) commitProjectConfig(commit Commit) *ProjectConfig {
+	if commit.Project == "" {
+		return s.projectConfig(s.Project)
+	}
+	return s.projectConfig(commit.Project)
+}
+
+// Returns true if events from the project should be acted on.
+func (s *State) watchesProject(project string) bool {
+	if project == s.Project {
+		return true
+	}
+	if s.Config != nil {
+		_, ok := s.Config.Projects[project]
+		return ok
+	}
+	return false
+}
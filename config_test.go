@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("failed in setup: %s", err)
+	}
+	return path
+}
+
+func TestLoadConfigCases(t *testing.T) {
+	type testCase struct {
+		contents    string
+		expectation bool
+	}
+
+	testCases := []testCase{
+		// Empty configs are fine
+		{
+			contents:    `{}`,
+			expectation: true,
+		},
+		{
+			contents:    `{"projects": {"frc971": {"carry_forward_kinds": ["NO_CODE_CHANGE", "TRIVIAL_REBASE"], "carry_forward_mode": "keep"}}}`,
+			expectation: true,
+		},
+		// Typos in keys are caught
+		{
+			contents:    `{"projects": {"frc971": {"carry_forward_kind": ["NO_CODE_CHANGE"]}}}`,
+			expectation: false,
+		},
+		// Unknown kinds are caught
+		{
+			contents:    `{"projects": {"frc971": {"carry_forward_kinds": ["TRIVIAL"]}}}`,
+			expectation: false,
+		},
+		// Reworks change the code
+		{
+			contents:    `{"projects": {"frc971": {"carry_forward_kinds": ["REWORK"]}}}`,
+			expectation: false,
+		},
+		{
+			contents:    `{"projects": {"frc971": {"carry_forward_mode": "sometimes"}}}`,
+			expectation: false,
+		},
+	}
+
+	for id, tc := range testCases {
+		_, err := LoadConfig(writeConfig(t, tc.contents))
+		if (err == nil) != tc.expectation {
+			t.Fatalf("expected success %v for case %d but got %v", tc.expectation, id, err)
+		}
+	}
+}
+
+func TestProjectConfigDefaults(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {"carry_forward_kinds": ["NO_CODE_CHANGE"]}}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	state := &State{Config: config}
+
+	if mode := state.projectConfig("frc971").CarryForwardMode; mode != CarryForwardCopy {
+		t.Fatalf("expected default mode %s but got %s", CarryForwardCopy, mode)
+	}
+	if kinds := state.projectConfig("other").CarryForwardKinds; len(kinds) != 0 {
+		t.Fatalf("expected nothing carried forward for unconfigured projects but got %v", kinds)
+	}
+	// The defaults are only built once.
+	if state.projectConfig("other") != state.projectConfig("another") || state.pipelineConfig("frc971", "ci") != state.pipelineConfig("other", "docs") {
+		t.Fatalf("expected unconfigured projects and pipelines to share their defaults")
+	}
+}
+
+func TestDraftPolicies(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `{"projects": {
+		"skip": {"wip_policy": "skip", "private_policy": "skip"},
+		"restricted": {"private_policy": "restricted", "private_pipeline": "ci-private"}
+	}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	state := &State{Config: config}
+
+	type testCase struct {
+		change     Change
+		skip       string
+		restricted string
+	}
+
+	testCases := []testCase{
+		{change: Change{Project: "skip"}},
+		{change: Change{Project: "skip", Wip: true}, skip: "work in progress"},
+		{change: Change{Project: "skip", Private: true}, skip: "private"},
+		{change: Change{Project: "restricted", Wip: true}},
+		{change: Change{Project: "restricted", Private: true}, restricted: "ci-private"},
+		{change: Change{Project: "other", Wip: true, Private: true}},
+	}
+
+	for id, tc := range testCases {
+		if skip := state.skipReason(&tc.change); skip != tc.skip {
+			t.Errorf("expected skip reason %q for case %d but got %q", tc.skip, id, skip)
+		}
+		if restricted := state.restrictedPipeline(&tc.change); restricted != tc.restricted {
+			t.Errorf("expected restricted pipeline %q for case %d but got %q", tc.restricted, id, restricted)
+		}
+	}
+
+	if _, err := LoadConfig(writeConfig(t, `{"projects": {"p": {"private_policy": "restricted"}}}`)); err == nil {
+		t.Fatalf("expected restricted without a pipeline to be rejected")
+	}
+}
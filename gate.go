@@ -0,0 +1,571 @@
+package main
+
+// Gating approved changes through a merge queue.
+//
+// Approved changes are queued per project and branch.  Each change is built on top of the branch tip plus every change ahead of it in the queue,
+// and is submitted once it reaches the head of the queue with a passing build.  Failing changes are ejected, and the changes behind them rebuilt without them.
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+const (
+	GateQueued   = "queued"
+	GateBuilding = "building"
+	GatePassed   = "passed"
+	GateFailed   = "failed"
+	// Passed and being submitted, so nothing behind it is submitted first.
+	GateSubmitting = "submitting"
+)
+
+// A gate queue, for locking.
+type gateQueueKey struct {
+	project string
+	branch  string
+}
+
+// Locks the gate queue of a project and branch, returning the function which unlocks it.
+func (s *State) lockGateQueue(project string, branch string) func() {
+	return s.gateQueues.Lock(gateQueueKey{project: project, branch: branch})
+}
+
+type GateItem struct {
+	ID           int64
+	Project      string
+	Branch       string
+	ChangeId     string
+	ChangeNumber int
+	Patchset     int
+	Revision     string
+	Ref          string
+	State        string
+	// Buildkite build of the change, empty until one has been created.
+	Build  string
+	Number int
+	WebURL string
+	// Counts the rebuilds of the item after changes ahead of it were ejected, so builds started before are dropped.
+	Attempt int
+}
+
+const gateItemColumns = "id, project, branch, changeid, changenumber, patchset, revision, ref, state, coalesce(build, ''), coalesce(number, 0), coalesce(weburl, ''), coalesce(attempt, 0)"
+
+func scanGateItem(row interface{ Scan(...any) error }) (GateItem, error) {
+	var item GateItem
+	err := row.Scan(&item.ID, &item.Project, &item.Branch, &item.ChangeId, &item.ChangeNumber, &item.Patchset,
+		&item.Revision, &item.Ref, &item.State, &item.Build, &item.Number, &item.WebURL, &item.Attempt)
+	return item, err
+}
+
+// Returns the gate queue of a project and branch, head first.
+func (s *State) GetGateQueue(project string, branch string) []GateItem {
+	rows, err := s.DB.Query("select "+gateItemColumns+" from gate_queue where project = ? and branch = ? order by id", project, branch)
+	if err != nil {
+		log.Fatalf("Failed to query: '%v'", err)
+	}
+	defer rows.Close()
+
+	var result []GateItem
+	for rows.Next() {
+		item, err := scanGateItem(rows)
+		if err != nil {
+			log.Fatalf("Failed to scan: '%v'", err)
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+// Returns the queued item of a change.
+func (s *State) GetGateItemForChange(changeNumber int) (GateItem, bool) {
+	item, err := scanGateItem(s.DB.QueryRow("select "+gateItemColumns+" from gate_queue where changenumber = ?", changeNumber))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Fatalf("Failed to query: '%v'", err)
+		}
+		return item, false
+	}
+	return item, true
+}
+
+// Returns the queued item a gate build belongs to.
+func (s *State) GetGateItemForBuild(build string) (GateItem, bool) {
+	item, err := scanGateItem(s.DB.QueryRow("select "+gateItemColumns+" from gate_queue where build = ?", build))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Fatalf("Failed to query: '%v'", err)
+		}
+		return item, false
+	}
+	return item, true
+}
+
+// Adds a change to the end of its queue.
+func (s *State) AddGateItem(item GateItem) GateItem {
+	result, err := s.DB.Exec("insert into gate_queue (project, branch, changeid, changenumber, patchset, revision, ref, state) values (?, ?, ?, ?, ?, ?, ?, ?)",
+		item.Project, item.Branch, item.ChangeId, item.ChangeNumber, item.Patchset, item.Revision, item.Ref, GateQueued)
+	if err != nil {
+		log.Fatalf("Failed to exec: %s", err)
+	}
+	item.ID, _ = result.LastInsertId()
+	item.State = GateQueued
+	return item
+}
+
+// Updates the state and build of a queued item.
+func (s *State) SetGateItemState(id int64, state string, build string, webURL string) {
+	if _, err := s.DB.Exec("update gate_queue set state = ?, build = ?, weburl = ? where id = ?", state, build, webURL, id); err != nil {
+		log.Fatalf("Failed to exec: %s", err)
+	}
+}
+
+// Records the build started for a queued item.
+func (s *State) SetGateItemBuild(id int64, build string, number int, webURL string) {
+	if _, err := s.DB.Exec("update gate_queue set state = ?, build = ?, number = ?, weburl = ? where id = ?", GateBuilding, build, number, webURL, id); err != nil {
+		log.Fatalf("Failed to exec: %s", err)
+	}
+}
+
+func (s *State) RemoveGateItem(id int64) {
+	if _, err := s.DB.Exec("delete from gate_queue where id = ?", id); err != nil {
+		log.Fatalf("Failed to exec: %s", err)
+	}
+}
+
+// Returns true if the approvals of a comment-added event moved the label to the value.
+func approvalReached(approvals []Approval, label string, value string) bool {
+	want, _ := strconv.Atoi(value)
+	for _, approval := range approvals {
+		if approval.Type != label || approval.OldValue == "" {
+			continue
+		}
+		newValue, err := strconv.Atoi(approval.Value)
+		if err != nil {
+			continue
+		}
+		oldValue, _ := strconv.Atoi(approval.OldValue)
+		if newValue == want && oldValue != want {
+			return true
+		}
+	}
+	return false
+}
+
+// Handles a comment-added event, adding the change to the gate queue if it was just approved.
+func (s *State) handleGateApproval(eventInfo EventInfo, client *buildkite.Client) {
+	if !s.watchesProject(eventInfo.Project) || eventInfo.Change == nil || eventInfo.PatchSet == nil || s.isOwnEvent(eventInfo) {
+		return
+	}
+	gate := s.projectConfig(eventInfo.Project).Gate
+	if gate == nil || !approvalReached(eventInfo.Approvals, gate.Label, gate.Value) {
+		return
+	}
+	if !s.authorizedUser(eventInfo) {
+		return
+	}
+
+	unlock := s.lockGateQueue(eventInfo.Change.Project, eventInfo.Change.Branch)
+	s.mu.Lock()
+	if _, ok := s.GetGateItemForChange(eventInfo.Change.Number); ok {
+		s.mu.Unlock()
+		unlock()
+		log.Printf("Change %d is already in the gate queue", eventInfo.Change.Number)
+		return
+	}
+	item := s.AddGateItem(GateItem{
+		Project:      eventInfo.Change.Project,
+		Branch:       eventInfo.Change.Branch,
+		ChangeId:     eventInfo.Change.ID,
+		ChangeNumber: eventInfo.Change.Number,
+		Patchset:     eventInfo.PatchSet.Number,
+		Revision:     eventInfo.PatchSet.Revision,
+		Ref:          eventInfo.PatchSet.Ref,
+	})
+	queue := s.GetGateQueue(item.Project, item.Branch)
+	s.mu.Unlock()
+	unlock()
+
+	log.Printf("Added %d,%d to the %s %s gate queue at position %d", item.ChangeNumber, item.Patchset, item.Project, item.Branch, len(queue))
+	// Buildkite may keep us retrying, so don't hold up the gerrit events behind this one.
+	go func() {
+		s.review(item.ChangeNumber, item.Patchset, Review{
+			Message: fmt.Sprintf("Added to the %s gate queue at position %d.", item.Branch, len(queue)),
+			Notify:  "NONE",
+		})
+		s.startGateBuild(client, queue[:len(queue)-1], item)
+	}()
+}
+
+// Starts the gate build of an item on top of the items ahead of it.  Gives up once the item is ejected or restarted,
+// since whoever restarted it starts the build it needs.
+func (s *State) startGateBuild(client *buildkite.Client, ahead []GateItem, item GateItem) {
+	pipeline := s.gatePipeline(item.Project)
+
+	var refs, numbers []string
+	for _, a := range append(ahead, item) {
+		refs = append(refs, a.Ref)
+		numbers = append(numbers, fmt.Sprintf("%d", a.ChangeNumber))
+	}
+
+	for {
+		s.mu.Lock()
+		wanted := s.gateBuildWanted(item)
+		s.mu.Unlock()
+		if !wanted {
+			log.Printf("Not building attempt %d of %d,%d in the gate, it was ejected or restarted", item.Attempt, item.ChangeNumber, item.Patchset)
+			return
+		}
+		superseded := false
+		build, err := s.tryCreateBuild(
+			client, pipeline, &buildkite.CreateBuild{
+				Commit:  item.Revision,
+				Branch:  item.ChangeId,
+				Message: fmt.Sprintf("Gate %s %s: %s", item.Project, item.Branch, strings.Join(numbers, " ")),
+				Env: map[string]string{
+					"GERRIT_GATE":          "true",
+					"GERRIT_PROJECT":       item.Project,
+					"GERRIT_BRANCH":        item.Branch,
+					"GERRIT_CHANGE_NUMBER": fmt.Sprintf("%d", item.ChangeNumber),
+					"GERRIT_PATCH_NUMBER":  fmt.Sprintf("%d", item.Patchset),
+					// The pipeline merges these, in order, onto the tip of the branch.
+					"GERRIT_GATE_CHANGES": strings.Join(numbers, " "),
+					"GERRIT_GATE_REFS":    strings.Join(refs, " "),
+				},
+			}, func(build *buildkite.Build) {
+				unlock := s.lockGateQueue(item.Project, item.Branch)
+				defer unlock()
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				if !s.gateBuildWanted(item) {
+					superseded = true
+					return
+				}
+				webURL := ""
+				if build.WebURL != nil {
+					webURL = *build.WebURL
+				}
+				number := 0
+				if build.Number != nil {
+					number = *build.Number
+				}
+				s.SetGateItemBuild(item.ID, *build.ID, number, webURL)
+			})
+		if err == nil && build.ID != nil {
+			if superseded {
+				log.Printf("%d,%d was ejected or restarted while build %s was created", item.ChangeNumber, item.Patchset, *build.ID)
+				if build.Number != nil {
+					s.cancelGateBuild(client, pipeline, *build.Number)
+				}
+				return
+			}
+			webURL := ""
+			if build.WebURL != nil {
+				webURL = *build.WebURL
+			}
+			log.Printf("Scheduled gate build %s for %d,%d", *build.ID, item.ChangeNumber, item.Patchset)
+			s.review(item.ChangeNumber, item.Patchset, Review{
+				Message: fmt.Sprintf("Gate Build Started on top of %d changes ahead in the queue: %s", len(ahead), webURL),
+				Notify:  "NONE",
+			})
+			return
+		}
+		log.Printf("Failed to trigger gate build: %v", err)
+		log.Printf("Trying again in 30 seconds")
+		time.Sleep(30 * time.Second)
+	}
+}
+
+// Returns the pipeline gate builds of a project run in.
+func (s *State) gatePipeline(project string) string {
+	if gate := s.projectConfig(project).Gate; gate != nil && gate.Pipeline != "" {
+		return gate.Pipeline
+	}
+	return s.BuildkiteProject
+}
+
+// Cancels a gate build nothing is waiting for anymore.
+func (s *State) cancelGateBuild(client *buildkite.Client, pipeline string, number int) {
+	if client == nil || number == 0 {
+		return
+	}
+	if err := cancelBuild(client, s.BuildkiteOrganization, pipeline, number); err != nil {
+		log.Printf("Failed to cancel gate build %s #%d: %v", pipeline, number, err)
+		return
+	}
+	log.Printf("Canceled superseded gate build %s #%d", pipeline, number)
+}
+
+// Returns true if an item is still waiting for the build of this attempt.  mu must be held.
+func (s *State) gateBuildWanted(item GateItem) bool {
+	current, ok := s.GetGateItemForChange(item.ChangeNumber)
+	return ok && current.ID == item.ID && current.State == GateQueued && current.Attempt == item.Attempt
+}
+
+// Marks an item as needing a new build, invalidating any build being started for it.  mu must be held.
+func (s *State) restartGateItem(item GateItem) GateItem {
+	if _, err := s.DB.Exec("update gate_queue set state = ?, build = '', weburl = '', attempt = coalesce(attempt, 0) + 1 where id = ?", GateQueued, item.ID); err != nil {
+		log.Fatalf("Failed to exec: %s", err)
+	}
+	item.State, item.Build, item.WebURL = GateQueued, "", ""
+	item.Attempt++
+	return item
+}
+
+// Handles a finished build if it is a gate build.  Returns false if it wasn't one.
+func (s *State) handleGateBuildFinished(build Build) bool {
+	s.mu.Lock()
+	item, ok := s.GetGateItemForBuild(build.ID)
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	state := GateFailed
+	if build.State == "passed" {
+		state = GatePassed
+	}
+	unlock := s.lockGateQueue(item.Project, item.Branch)
+	s.mu.Lock()
+	// The queue may have moved on while we waited for the lock.
+	current, ok := s.GetGateItemForBuild(build.ID)
+	if ok && current.State == GateBuilding {
+		s.SetGateItemState(item.ID, state, build.ID, build.WebURL)
+	}
+	s.mu.Unlock()
+	unlock()
+
+	log.Printf("Gate build %s of %d,%d %s", build.ID, item.ChangeNumber, item.Patchset, state)
+	s.processGateQueue(item.Project, item.Branch)
+	return true
+}
+
+// Submits passing changes from the head of the queue and ejects the first failure, rebuilding everything behind it.
+// Failures further back wait until they reach the head, since they may have been caused by a change ahead of them.
+// The head is claimed under the queue lock, and submitted after releasing it, so changes are submitted once and in order.
+func (s *State) processGateQueue(project string, branch string) {
+	for {
+		unlock := s.lockGateQueue(project, branch)
+		s.mu.Lock()
+		queue := s.GetGateQueue(project, branch)
+		var head GateItem
+		if len(queue) > 0 {
+			head = queue[0]
+			switch head.State {
+			case GatePassed:
+				s.SetGateItemState(head.ID, GateSubmitting, head.Build, head.WebURL)
+			case GateFailed:
+				s.RemoveGateItem(head.ID)
+			}
+		}
+		s.mu.Unlock()
+		unlock()
+		if len(queue) == 0 {
+			return
+		}
+
+		switch head.State {
+		case GatePassed:
+			err := s.review(head.ChangeNumber, head.Patchset, Review{
+				Message: fmt.Sprintf("Gate Build Succeeded, submitting: %s", head.WebURL),
+				Submit:  true,
+			})
+			unlock := s.lockGateQueue(project, branch)
+			s.mu.Lock()
+			s.RemoveGateItem(head.ID)
+			s.mu.Unlock()
+			unlock()
+			if err != nil {
+				s.ejectGateItem(head, fmt.Sprintf("Failed to submit, removed from the gate queue: %v", err))
+				return
+			}
+			log.Printf("Submitted %d,%d from the gate", head.ChangeNumber, head.Patchset)
+		case GateFailed:
+			s.ejectGateItem(head, fmt.Sprintf("Gate Build Failed, removed from the gate queue: %s", head.WebURL))
+			return
+		default:
+			return
+		}
+	}
+}
+
+// Reports a change which was removed from its queue and rebuilds the changes which were behind it, since their builds
+// included it.
+func (s *State) ejectGateItem(item GateItem, message string) {
+	log.Printf("Ejecting %d,%d from the gate: %s", item.ChangeNumber, item.Patchset, message)
+	if item.State == GateBuilding {
+		// Removed by a new patchset or abandon while it was building.
+		s.cancelGateBuild(s.Buildkite, s.gatePipeline(item.Project), item.Number)
+	}
+	s.review(item.ChangeNumber, item.Patchset, Review{Message: message})
+	s.rebuildGateQueue(item.Project, item.Branch, item.ID)
+}
+
+// Restarts the gate builds of the items queued behind an item, each on top of the items now ahead of it, canceling the
+// builds they had running, which included the item.  Queues are ordered by id, so the items behind are the ones with
+// larger ids.
+func (s *State) rebuildGateQueue(project string, branch string, after int64) {
+	type rebuild struct {
+		ahead []GateItem
+		item  GateItem
+	}
+	var rebuilds []rebuild
+	var superseded []int
+	unlock := s.lockGateQueue(project, branch)
+	s.mu.Lock()
+	queue := s.GetGateQueue(project, branch)
+	for i, item := range queue {
+		if item.ID <= after {
+			continue
+		}
+		if item.State == GateBuilding {
+			superseded = append(superseded, item.Number)
+		}
+		item = s.restartGateItem(item)
+		queue[i] = item
+		rebuilds = append(rebuilds, rebuild{ahead: queue[:i], item: item})
+	}
+	s.mu.Unlock()
+	unlock()
+
+	for _, number := range superseded {
+		s.cancelGateBuild(s.Buildkite, s.gatePipeline(project), number)
+	}
+	for _, r := range rebuilds {
+		s.startGateBuild(s.Buildkite, r.ahead, r.item)
+	}
+}
+
+// Picks the gate queues back up after a restart, in the background.  Results of builds which finished while we were
+// down are fetched from Buildkite, items which never got a build are built, and interrupted submissions are retried.
+func (s *State) resumeGateQueues() {
+	rows, err := s.DB.Query("select distinct project, branch from gate_queue")
+	if err != nil {
+		log.Fatalf("Failed to query: '%v'", err)
+	}
+	var queues []gateQueueKey
+	for rows.Next() {
+		var queue gateQueueKey
+		if err := rows.Scan(&queue.project, &queue.branch); err != nil {
+			log.Fatalf("Failed to scan: '%v'", err)
+		}
+		queues = append(queues, queue)
+	}
+	rows.Close()
+
+	for _, queue := range queues {
+		log.Printf("Resuming the %s %s gate queue", queue.project, queue.branch)
+		go s.resumeGateQueue(queue.project, queue.branch)
+	}
+}
+
+// Resumes one gate queue.
+func (s *State) resumeGateQueue(project string, branch string) {
+	type rebuild struct {
+		ahead []GateItem
+		item  GateItem
+	}
+	var rebuilds []rebuild
+	pipeline := s.gatePipeline(project)
+
+	unlock := s.lockGateQueue(project, branch)
+	s.mu.Lock()
+	queue := s.GetGateQueue(project, branch)
+	s.mu.Unlock()
+	unlock()
+
+	for i, item := range queue {
+		switch item.State {
+		case GateSubmitting:
+			unlock := s.lockGateQueue(project, branch)
+			s.mu.Lock()
+			s.SetGateItemState(item.ID, GatePassed, item.Build, item.WebURL)
+			s.mu.Unlock()
+			unlock()
+		case GateBuilding:
+			build, err := getBuildJobs(s.Buildkite, s.BuildkiteOrganization, pipeline, item.Number)
+			if err != nil {
+				log.Printf("Failed to fetch gate build %s of %d,%d, rebuilding: %v", item.Build, item.ChangeNumber, item.Patchset, err)
+				s.cancelGateBuild(s.Buildkite, pipeline, item.Number)
+				unlock := s.lockGateQueue(project, branch)
+				s.mu.Lock()
+				rebuilds = append(rebuilds, rebuild{ahead: queue[:i], item: s.restartGateItem(item)})
+				s.mu.Unlock()
+				unlock()
+				continue
+			}
+			if !slices.Contains(buildStates, build.State) {
+				// Still running, its webhook finishes it.
+				continue
+			}
+			state := GateFailed
+			if build.State == "passed" {
+				state = GatePassed
+			}
+			log.Printf("Gate build %s of %d,%d %s while we were down", item.Build, item.ChangeNumber, item.Patchset, state)
+			unlock := s.lockGateQueue(project, branch)
+			s.mu.Lock()
+			if current, ok := s.GetGateItemForBuild(item.Build); ok && current.State == GateBuilding {
+				s.SetGateItemState(item.ID, state, item.Build, item.WebURL)
+			}
+			s.mu.Unlock()
+			unlock()
+		case GateQueued:
+			unlock := s.lockGateQueue(project, branch)
+			s.mu.Lock()
+			rebuilds = append(rebuilds, rebuild{ahead: queue[:i], item: s.restartGateItem(item)})
+			s.mu.Unlock()
+			unlock()
+		}
+	}
+
+	// Submit what passed first, ejections restart the items behind them, and the builds below notice and skip them.
+	s.processGateQueue(project, branch)
+	for _, r := range rebuilds {
+		s.startGateBuild(s.Buildkite, r.ahead, r.item)
+	}
+}
+
+// Handles a change which was updated outside the gate, removing it from the queue.
+// A new patchset or abandoning the change invalidates the approval, and a change merged by hand no longer needs gating.
+// Rebuilding the queue happens in the background, so gerrit events aren't held up by Buildkite.
+func (s *State) handleGateChangeUpdated(eventInfo EventInfo) {
+	if eventInfo.Change == nil {
+		return
+	}
+
+	s.mu.Lock()
+	item, ok := s.GetGateItemForChange(eventInfo.Change.Number)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	unlock := s.lockGateQueue(item.Project, item.Branch)
+	s.mu.Lock()
+	item, ok = s.GetGateItemForChange(eventInfo.Change.Number)
+	if ok && item.State == GateSubmitting && eventInfo.Type == "change-merged" {
+		// Our own submission, which processGateQueue removes once gerrit answers.
+		ok = false
+	} else if ok {
+		s.RemoveGateItem(item.ID)
+	}
+	s.mu.Unlock()
+	unlock()
+	if !ok {
+		return
+	}
+
+	if eventInfo.Type == "change-merged" {
+		// Everything behind was built on top of it, which is exactly what the branch looks like now.
+		log.Printf("Change %d merged outside the gate, removed from the queue", item.ChangeNumber)
+		go s.processGateQueue(item.Project, item.Branch)
+		return
+	}
+	go s.ejectGateItem(item, fmt.Sprintf("Removed from the gate queue after %s.", eventInfo.Type))
+}
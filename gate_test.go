@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+func TestApprovalReached(t *testing.T) {
+	type testCase struct {
+		approvals   []Approval
+		expectation bool
+	}
+
+	testCases := []testCase{
+		// Newly approved
+		{
+			approvals:   []Approval{{Type: "Code-Review", Value: "2", OldValue: "1"}},
+			expectation: true,
+		},
+		{
+			approvals:   []Approval{{Type: "Verified", Value: "1"}, {Type: "Code-Review", Value: "+2", OldValue: "0"}},
+			expectation: true,
+		},
+		// Already approved, gerrit repeats the current votes on every comment
+		{
+			approvals:   []Approval{{Type: "Code-Review", Value: "2"}},
+			expectation: false,
+		},
+		// Not enough
+		{
+			approvals:   []Approval{{Type: "Code-Review", Value: "1", OldValue: "0"}},
+			expectation: false,
+		},
+		// Approval removed
+		{
+			approvals:   []Approval{{Type: "Code-Review", Value: "0", OldValue: "2"}},
+			expectation: false,
+		},
+		// Other label
+		{
+			approvals:   []Approval{{Type: "Verified", Value: "2", OldValue: "0"}},
+			expectation: false,
+		},
+	}
+
+	for id, tc := range testCases {
+		if reached := approvalReached(tc.approvals, "Code-Review", "2"); reached != tc.expectation {
+			t.Fatalf("expected %v for case %d but got %v", tc.expectation, id, reached)
+		}
+	}
+}
+
+func TestGateQueue(t *testing.T) {
+	state := setupTestState(t)
+
+	first := state.AddGateItem(GateItem{Project: "p", Branch: "main", ChangeNumber: 1, Patchset: 1, Ref: "refs/changes/01/1/1"})
+	state.AddGateItem(GateItem{Project: "p", Branch: "release", ChangeNumber: 2, Patchset: 1})
+	third := state.AddGateItem(GateItem{Project: "p", Branch: "main", ChangeNumber: 3, Patchset: 2})
+
+	queue := state.GetGateQueue("p", "main")
+	if len(queue) != 2 || queue[0].ChangeNumber != 1 || queue[1].ChangeNumber != 3 || queue[0].State != GateQueued {
+		t.Fatalf("unexpected queue %#v", queue)
+	}
+
+	state.SetGateItemState(third.ID, GateBuilding, "build-3", "https://buildkite.com/3")
+	item, ok := state.GetGateItemForBuild("build-3")
+	if !ok || item.ChangeNumber != 3 || item.State != GateBuilding || item.WebURL != "https://buildkite.com/3" {
+		t.Fatalf("unexpected item %#v %v", item, ok)
+	}
+
+	state.RemoveGateItem(first.ID)
+	if _, ok := state.GetGateItemForChange(1); ok {
+		t.Fatalf("expected change 1 to be removed")
+	}
+	if queue := state.GetGateQueue("p", "main"); len(queue) != 1 || queue[0].ChangeNumber != 3 {
+		t.Fatalf("unexpected queue %#v", queue)
+	}
+}
+
+// Slow Buildkite creates in one gate queue hold up neither gerrit events nor other queues, and builds started before a
+// change ahead was ejected are dropped.
+func TestGateQueueLocking(t *testing.T) {
+	state := setupTestState(t)
+	state.DB.SetMaxOpenConns(1)
+
+	release := make(chan bool)
+	var mu sync.Mutex
+	var submitted []string
+	var creates []buildkite.CreateBuild
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/submit"):
+			mu.Lock()
+			submitted = append(submitted, r.URL.Path)
+			mu.Unlock()
+		case strings.HasPrefix(r.URL.Path, "/a/changes/"):
+		default:
+			var create buildkite.CreateBuild
+			json.NewDecoder(r.Body).Decode(&create)
+			<-release
+			mu.Lock()
+			creates = append(creates, create)
+			mu.Unlock()
+			id := "gate-" + create.Env["GERRIT_GATE_CHANGES"]
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "number": 1, "web_url": "https://buildkite.com/" + id})
+		}
+	}))
+	defer server.Close()
+
+	state.Project = "p"
+	state.Buildkite = testBuildkiteClient(t, server)
+	state.BuildkiteOrganization = "org"
+	state.REST = NewGerritREST(server.URL, "buildkite", "secret")
+	state.ReviewTransport = ReviewOverREST
+
+	ejected := state.AddGateItem(GateItem{Project: "p", Branch: "main", ChangeNumber: 1, Patchset: 1})
+	state.SetGateItemState(ejected.ID, GateBuilding, "gate-1", "")
+	behind := state.AddGateItem(GateItem{Project: "p", Branch: "main", ChangeNumber: 2, Patchset: 1})
+	passed := state.AddGateItem(GateItem{Project: "p", Branch: "release", ChangeNumber: 3, Patchset: 1})
+	state.SetGateItemState(passed.ID, GatePassed, "gate-3", "")
+
+	// The build of the change behind, on top of the change about to be ejected.
+	started := make(chan bool)
+	go func() {
+		state.startGateBuild(state.Buildkite, []GateItem{ejected}, behind)
+		started <- true
+	}()
+
+	done := make(chan bool)
+	go func() {
+		state.handleGateChangeUpdated(EventInfo{Type: "patchset-created", Change: &Change{Number: 1}})
+		state.processGateQueue("p", "release")
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("gate events waited for Buildkite")
+	}
+	mu.Lock()
+	if len(submitted) != 1 || submitted[0] != "/a/changes/3/submit" {
+		t.Fatalf("expected the release queue to be submitted but got %v", submitted)
+	}
+	mu.Unlock()
+
+	// Wait for the ejection to restart the change behind before letting the builds be created.
+	for i := 0; ; i++ {
+		if item, _ := state.GetGateItemForChange(2); item.Attempt == 1 {
+			break
+		}
+		if i == 500 {
+			t.Fatalf("the change behind wasn't restarted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	<-started
+	for i := 0; ; i++ {
+		if item, _ := state.GetGateItemForChange(2); item.State == GateBuilding {
+			if item.Build != "gate-2" || item.Attempt != 1 {
+				t.Fatalf("expected the rebuild without the ejected change but got %#v", item)
+			}
+			break
+		}
+		if i == 500 {
+			t.Fatalf("the change behind wasn't rebuilt")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := state.GetGateItemForChange(3); ok {
+		t.Fatalf("expected the submitted change to leave the queue")
+	}
+}
+
+// Queues left behind by a restart are picked back up, and builds behind an ejected change are canceled.
+func TestGateResume(t *testing.T) {
+	state := setupTestState(t)
+
+	var mu sync.Mutex
+	var submitted, canceled []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/submit"):
+			submitted = append(submitted, r.URL.Path)
+		case strings.HasPrefix(r.URL.Path, "/a/changes/"):
+		case strings.HasSuffix(r.URL.Path, "/cancel"):
+			canceled = append(canceled, r.URL.Path)
+		case r.Method == "POST":
+			var create buildkite.CreateBuild
+			json.NewDecoder(r.Body).Decode(&create)
+			id := "gate-" + create.Env["GERRIT_GATE_CHANGES"]
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "number": 10, "web_url": "https://buildkite.com/" + id})
+		case strings.HasSuffix(r.URL.Path, "/builds/5"):
+			w.Write([]byte(`{"number": 5, "state": "failed"}`))
+		case strings.HasSuffix(r.URL.Path, "/builds/6"):
+			w.Write([]byte(`{"number": 6, "state": "running"}`))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	state.Project = "p"
+	state.BuildkiteProject = "gate"
+	state.Buildkite = testBuildkiteClient(t, server)
+	state.BuildkiteOrganization = "org"
+	state.REST = NewGerritREST(server.URL, "buildkite", "secret")
+	state.ReviewTransport = ReviewOverREST
+
+	// Interrupted while submitting.
+	submitting := state.AddGateItem(GateItem{Project: "p", Branch: "main", ChangeNumber: 1, Patchset: 1})
+	state.SetGateItemState(submitting.ID, GateSubmitting, "gate-1", "")
+	// Failed while we were down.
+	failed := state.AddGateItem(GateItem{Project: "p", Branch: "main", ChangeNumber: 2, Patchset: 1})
+	state.SetGateItemBuild(failed.ID, "gate-1 2", 5, "")
+	// Still running, on top of the failure.
+	running := state.AddGateItem(GateItem{Project: "p", Branch: "main", ChangeNumber: 3, Patchset: 1})
+	state.SetGateItemBuild(running.ID, "gate-1 2 3", 6, "")
+	// Never got a build.
+	state.AddGateItem(GateItem{Project: "p", Branch: "main", ChangeNumber: 4, Patchset: 1})
+
+	state.resumeGateQueue("p", "main")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(submitted) != 1 || submitted[0] != "/a/changes/1/submit" {
+		t.Fatalf("expected the interrupted submission to be retried but got %v", submitted)
+	}
+	if len(canceled) != 1 || canceled[0] != "/v2/organizations/org/pipelines/gate/builds/6/cancel" {
+		t.Fatalf("expected the build behind the failure to be canceled but got %v", canceled)
+	}
+	queue := state.GetGateQueue("p", "main")
+	if len(queue) != 2 || queue[0].Build != "gate-3" || queue[1].Build != "gate-3 4" || queue[0].State != GateBuilding || queue[1].State != GateBuilding {
+		t.Fatalf("expected the rest of the queue rebuilt without the failure but got %#v", queue)
+	}
+}
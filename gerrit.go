@@ -26,6 +26,15 @@ type PatchSet struct {
 	Kind           string   `json:"kind,omitempty"`
 	SizeInsertions int      `json:"sizeInsertions,omitempty"`
 	SizeDeletions  int      `json:"sizeDeletions,omitempty"`
+	// Only set by "gerrit query --files".
+	Files []PatchSetFile `json:"files,omitempty"`
+}
+
+type PatchSetFile struct {
+	File       string `json:"file"`
+	Type       string `json:"type"`
+	Insertions int    `json:"insertions"`
+	Deletions  int    `json:"deletions"`
 }
 
 type Change struct {
@@ -94,3 +103,13 @@ type EventInfo struct {
 	Removed        []string   `json:"removed,omitempty"`
 	Hashtags       []string   `json:"hashtags,omitempty"`
 }
+
+// A change as returned by "gerrit query --format=JSON".
+type QueryChange struct {
+	Change
+	Open            bool       `json:"open"`
+	CurrentPatchSet *PatchSet  `json:"currentPatchSet,omitempty"`
+	PatchSets       []PatchSet `json:"patchSets,omitempty"`
+	// Set to "stats" on the summary row at the end of the results.
+	Type string `json:"type,omitempty"`
+}
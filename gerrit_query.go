@@ -0,0 +1,71 @@
+package main
+
+// Querying gerrit for changes over ssh.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// Runs "gerrit query" with the provided search and options, and returns the matching changes.
+func (s *State) query(search string, options ...string) ([]QueryChange, error) {
+	args := []string{"gerrit", "query", "--format=JSON"}
+	args = append(args, options...)
+	args = append(args, gerritQuote(search))
+
+	cmd := exec.Command("ssh", append([]string{"-p", "29418", "-i", s.Key, s.User + "@" + s.Server}, args...)...)
+	log.Printf("Running 'ssh -p 29418 -i %s %s@%s %s'", s.Key, s.User, s.Server, strings.Join(args, " "))
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("gerrit query %q failed: %w: %s", search, err, stderr.String())
+	}
+	return parseQueryResults(out)
+}
+
+// Quotes a value as a phrase of a gerrit search, so operators in it aren't interpreted.  query quotes the whole search
+// for ssh with gerritQuote, but gerrit has no escapes inside phrases, so values holding double quotes are wrapped in
+// braces instead.
+func gerritQueryPhrase(value string) (string, error) {
+	if !strings.Contains(value, `"`) {
+		return `"` + value + `"`, nil
+	}
+	if !strings.ContainsAny(value, "{}") {
+		return "{" + value + "}", nil
+	}
+	return "", fmt.Errorf("%q can't be quoted in a gerrit search", value)
+}
+
+// Parses the output of "gerrit query --format=JSON", one change per line followed by a stats row.
+func parseQueryResults(out []byte) ([]QueryChange, error) {
+	var result []QueryChange
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	maxBufferSize := 1024 * 1024
+	scanner.Buffer(make([]byte, maxBufferSize), maxBufferSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var change QueryChange
+		if err := json.Unmarshal(line, &change); err != nil {
+			return nil, fmt.Errorf("failed to parse query result %q: %w", string(line), err)
+		}
+		if change.Type == "stats" {
+			continue
+		}
+		if change.Type == "error" {
+			return nil, fmt.Errorf("query failed: %s", string(line))
+		}
+		result = append(result, change)
+	}
+	return result, scanner.Err()
+}
@@ -0,0 +1,160 @@
+package main
+
+// A minimal client for the gerrit REST API, for operations which aren't available over ssh.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type GerritREST struct {
+	// Base URL of the gerrit server, eg; https://gerrit.example.com
+	URL string
+	// HTTP credentials of the bridge's gerrit account.
+	User     string
+	Password string
+
+	Client *http.Client
+}
+
+func NewGerritREST(url string, user string, password string) *GerritREST {
+	return &GerritREST{
+		URL:      strings.TrimSuffix(url, "/"),
+		User:     user,
+		Password: password,
+		Client:   &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// Gerrit prefixes JSON responses with this to prevent XSSI.
+const gerritMagicPrefix = ")]}'"
+
+// Calls an authenticated REST endpoint, encoding in as the JSON request body if not nil and decoding the response into out if not nil.
+func (g *GerritREST) do(method string, path string, in any, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, g.URL+"/a"+path, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(g.User, g.Password)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	data = bytes.TrimPrefix(data, []byte(gerritMagicPrefix))
+	return json.Unmarshal(data, out)
+}
+
+// The parts of a ChangeInfo we use.
+type ChangeInfo struct {
+	ID              string                  `json:"id"`
+	Project         string                  `json:"project"`
+	Branch          string                  `json:"branch"`
+	ChangeId        string                  `json:"change_id"`
+	Subject         string                  `json:"subject"`
+	Number          int                     `json:"_number"`
+	CurrentRevision string                  `json:"current_revision,omitempty"`
+	Revisions       map[string]RevisionInfo `json:"revisions,omitempty"`
+}
+
+type RevisionInfo struct {
+	Number int    `json:"_number"`
+	Ref    string `json:"ref"`
+}
+
+// Returns a change along with its current revision.
+func (g *GerritREST) GetChange(changeNumber int) (*ChangeInfo, error) {
+	var change ChangeInfo
+	if err := g.do("GET", fmt.Sprintf("/changes/%d?o=CURRENT_REVISION", changeNumber), nil, &change); err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// Creates a change reverting a merged change.
+func (g *GerritREST) Revert(changeNumber int, message string) (*ChangeInfo, error) {
+	var change ChangeInfo
+	if err := g.do("POST", fmt.Sprintf("/changes/%d/revert", changeNumber), map[string]string{"message": message}, &change); err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// Adds hashtags to a change.
+func (g *GerritREST) AddHashtags(changeNumber int, hashtags ...string) error {
+	return g.do("POST", fmt.Sprintf("/changes/%d/hashtags", changeNumber), map[string][]string{"add": hashtags}, nil)
+}
+
+// Deletes the vote of an account on a label of a change.  account is a username, email or account ID.
+func (g *GerritREST) DeleteVote(changeNumber int, account string, label string) error {
+	return g.do("DELETE", fmt.Sprintf("/changes/%d/reviewers/%s/votes/%s", changeNumber, url.PathEscape(account), url.PathEscape(label)), nil, nil)
+}
+
+type ReviewInput struct {
+	Message string         `json:"message,omitempty"`
+	Labels  map[string]int `json:"labels,omitempty"`
+	Notify  string         `json:"notify,omitempty"`
+}
+
+// Posts a review on a revision, submitting the change afterwards if asked to.
+func (g *GerritREST) Review(changeNumber int, patchset int, review Review) error {
+	input := ReviewInput{
+		Message: review.Message,
+		Notify:  review.Notify,
+	}
+	if len(review.Labels) > 0 {
+		input.Labels = map[string]int{}
+		for label, value := range review.Labels {
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("label %s value %q is not a number", label, value)
+			}
+			input.Labels[label] = v
+		}
+	}
+	if err := g.do("POST", fmt.Sprintf("/changes/%d/revisions/%d/review", changeNumber, patchset), input, nil); err != nil {
+		return err
+	}
+	if review.Submit {
+		return g.do("POST", fmt.Sprintf("/changes/%d/submit", changeNumber), map[string]string{}, nil)
+	}
+	return nil
+}
+
+// Returns the URL of a change in the web UI.
+func (g *GerritREST) ChangeURL(changeNumber int) string {
+	return fmt.Sprintf("%s/%d", g.URL, changeNumber)
+}
@@ -0,0 +1,147 @@
+package main
+
+// Hashtags which change how changes are built, like "full-ci" or "no-ci".
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+// Decisions recorded for hashtags.
+const (
+	HashtagSkipped = "skipped"
+	HashtagBuilt   = "built"
+)
+
+// What a hashtag did to a patchset.
+type HashtagDecision struct {
+	ChangeNumber int
+	Patchset     int
+	Hashtag      string
+	// HashtagSkipped or HashtagBuilt.
+	Decision string
+	// Pipelines built, for HashtagBuilt.
+	Pipelines []string
+}
+
+func (s *State) AddHashtagDecision(decision HashtagDecision) {
+	if _, err := s.DB.Exec("insert into hashtag_decisions (changenumber, patchset, hashtag, decision, pipelines) values (?, ?, ?, ?, ?)",
+		decision.ChangeNumber, decision.Patchset, decision.Hashtag, decision.Decision, strings.Join(decision.Pipelines, ",")); err != nil {
+		log.Fatalf("Failed to exec: %s", err)
+	}
+}
+
+// Returns the latest decision made for a patchset because of a hashtag.
+func (s *State) GetHashtagDecision(changeNumber int, patchset int) (HashtagDecision, bool) {
+	decision := HashtagDecision{ChangeNumber: changeNumber, Patchset: patchset}
+	var pipelines string
+	err := s.DB.QueryRow("select hashtag, decision, pipelines from hashtag_decisions where changenumber = ? and patchset = ? order by id desc limit 1",
+		changeNumber, patchset).Scan(&decision.Hashtag, &decision.Decision, &pipelines)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Fatalf("Failed to query: '%v'", err)
+		}
+		return decision, false
+	}
+	if pipelines != "" {
+		decision.Pipelines = strings.Split(pipelines, ",")
+	}
+	return decision, true
+}
+
+// Returns the first hashtag of a change which skips automatic builds, or "".
+func (s *State) skipHashtag(change *Change) string {
+	config := s.projectConfig(change.Project)
+	for _, hashtag := range change.Hashtags {
+		if h, ok := config.Hashtags[hashtag]; ok && h.Skip {
+			return hashtag
+		}
+	}
+	return ""
+}
+
+// Returns the pipelines the hashtags of a change ask to build in, and the hashtags asking for them.
+func (s *State) hashtagPipelines(change *Change) ([]string, []string) {
+	config := s.projectConfig(change.Project)
+	var pipelines, hashtags []string
+	for _, hashtag := range change.Hashtags {
+		h, ok := config.Hashtags[hashtag]
+		if !ok || len(h.Pipelines) == 0 {
+			continue
+		}
+		hashtags = append(hashtags, hashtag)
+		for _, pipeline := range h.Pipelines {
+			if !slices.Contains(pipelines, pipeline) {
+				pipelines = append(pipelines, pipeline)
+			}
+		}
+	}
+	return pipelines, hashtags
+}
+
+// Handles a hashtags-changed event.  Adding a hashtag with pipelines builds the current patchset in them,
+// and removing a hashtag which skipped the current patchset builds it.
+func (s *State) handleHashtagsChanged(eventInfo EventInfo, client *buildkite.Client) {
+	if !s.watchesProject(eventInfo.Project) || eventInfo.Change == nil {
+		return
+	}
+	config := s.projectConfig(eventInfo.Project)
+	if len(config.Hashtags) == 0 {
+		return
+	}
+	// The event lists the hashtags after the change.
+	if eventInfo.Hashtags != nil {
+		eventInfo.Change.Hashtags = eventInfo.Hashtags
+	}
+
+	build := false
+	for _, hashtag := range eventInfo.Added {
+		if h, ok := config.Hashtags[hashtag]; ok && len(h.Pipelines) > 0 {
+			log.Printf("Hashtag %s added to %d", hashtag, eventInfo.Change.Number)
+			build = true
+		}
+	}
+
+	// The event doesn't say which patchset is current.
+	changes, err := s.query(fmt.Sprintf("change:%d", eventInfo.Change.Number), "--current-patch-set")
+	if err != nil || len(changes) != 1 || changes[0].CurrentPatchSet == nil {
+		log.Printf("Failed to find the current patchset of %d: %v", eventInfo.Change.Number, err)
+		return
+	}
+	if !changes[0].Open {
+		return
+	}
+	patchSet := *changes[0].CurrentPatchSet
+
+	for _, hashtag := range eventInfo.Removed {
+		if h, ok := config.Hashtags[hashtag]; !ok || !h.Skip {
+			continue
+		}
+		if decision, ok := s.GetHashtagDecision(eventInfo.Change.Number, patchSet.Number); ok && decision.Decision == HashtagSkipped {
+			log.Printf("Hashtag %s which skipped %d,%d was removed", hashtag, eventInfo.Change.Number, patchSet.Number)
+			build = true
+		}
+	}
+	if !build {
+		return
+	}
+
+	if reason := s.skipReason(eventInfo.Change); reason != "" {
+		log.Printf("Not building %d,%d, the change is %s", eventInfo.Change.Number, patchSet.Number, reason)
+		return
+	}
+
+	// The event comes from whoever changed the hashtags, build as the uploader of the patchset.
+	eventInfo.PatchSet = &patchSet
+	eventInfo.Author = nil
+	eventInfo.Uploader = &patchSet.Uploader
+	if !s.authorizedUser(eventInfo) {
+		return
+	}
+	s.handleEvent(eventInfo, client)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashtagPolicies(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {
+		"verify_pipelines": ["linux"],
+		"hashtags": {
+			"full-ci": {"pipelines": ["linux", "embedded", "docs"]},
+			"docs": {"pipelines": ["docs", "website"]},
+			"no-ci": {"skip": true}
+		}
+	}}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	state := &State{Project: "frc971", Config: config}
+
+	type testCase struct {
+		hashtags  []string
+		skip      string
+		pipelines string
+	}
+
+	testCases := []testCase{
+		{hashtags: nil, skip: "", pipelines: ""},
+		{hashtags: []string{"unrelated"}, skip: "", pipelines: ""},
+		{hashtags: []string{"full-ci"}, skip: "", pipelines: "linux,embedded,docs"},
+		{hashtags: []string{"full-ci", "docs"}, skip: "", pipelines: "linux,embedded,docs,website"},
+		{hashtags: []string{"docs", "no-ci"}, skip: "no-ci", pipelines: "docs,website"},
+	}
+
+	for id, tc := range testCases {
+		change := &Change{Project: "frc971", Hashtags: tc.hashtags}
+		if skip := state.skipHashtag(change); skip != tc.skip {
+			t.Fatalf("expected skip %q for case %d but got %q", tc.skip, id, skip)
+		}
+		if pipelines, _ := state.hashtagPipelines(change); strings.Join(pipelines, ",") != tc.pipelines {
+			t.Fatalf("expected pipelines %q for case %d but got %v", tc.pipelines, id, pipelines)
+		}
+	}
+
+	for id, contents := range []string{
+		`{"projects": {"frc971": {"hashtags": {"full-ci": {}}}}}`,
+		`{"projects": {"frc971": {"hashtags": {"full-ci": {"pipelines": ["linux"], "skip": true}}}}}`,
+	} {
+		if _, err := LoadConfig(writeConfig(t, contents)); err == nil {
+			t.Fatalf("expected case %d to be rejected", id)
+		}
+	}
+}
+
+func TestHashtagDecisions(t *testing.T) {
+	state := setupTestState(t)
+
+	if _, ok := state.GetHashtagDecision(1234, 1); ok {
+		t.Fatalf("expected no decision yet")
+	}
+
+	state.AddHashtagDecision(HashtagDecision{ChangeNumber: 1234, Patchset: 1, Hashtag: "no-ci", Decision: HashtagSkipped})
+	state.AddHashtagDecision(HashtagDecision{ChangeNumber: 1234, Patchset: 2, Hashtag: "no-ci", Decision: HashtagSkipped})
+	state.AddHashtagDecision(HashtagDecision{ChangeNumber: 1234, Patchset: 2, Hashtag: "full-ci", Decision: HashtagBuilt, Pipelines: []string{"linux", "docs"}})
+
+	if decision, ok := state.GetHashtagDecision(1234, 1); !ok || decision.Decision != HashtagSkipped || decision.Hashtag != "no-ci" || decision.Pipelines != nil {
+		t.Fatalf("unexpected decision %#v %v", decision, ok)
+	}
+	decision, ok := state.GetHashtagDecision(1234, 2)
+	if !ok || decision.Decision != HashtagBuilt || decision.Hashtag != "full-ci" || strings.Join(decision.Pipelines, ",") != "linux,docs" {
+		t.Fatalf("unexpected decision %#v %v", decision, ok)
+	}
+}
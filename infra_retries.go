@@ -0,0 +1,40 @@
+package main
+
+// Retrying builds which failed because agents were lost rather than because of the change.
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Retries the jobs of a build which were lost to the infrastructure, and tells the changes it built.
+// Returns false if nothing could be retried, so the build should be reported as it is.
+func (s *State) retryInfraFailure(commit Commit, others []Commit, build Build, jobs *BuildkiteBuildJobs) bool {
+	var retried []string
+	for _, job := range jobs.FailedJobs() {
+		if err := retryJob(s.Buildkite, s.BuildkiteOrganization, commit.Pipeline, build.Number, job.ID); err != nil {
+			log.Printf("Failed to retry job %s of build %s: %v", job.ID, build.ID, err)
+			continue
+		}
+		log.Printf("Retried job %s (%s) of build %s after an infrastructure failure", job.ID, job.Name, build.ID)
+		retried = append(retried, job.Name)
+	}
+	if len(retried) == 0 {
+		return false
+	}
+
+	retries := commit.Retries + 1
+	s.SetBuildRetries(build.ID, retries)
+
+	// The vote was reset when the build started, and the retried jobs finish in the same build.
+	message := fmt.Sprintf("Retrying %d jobs lost to infrastructure failures (%s), attempt %d of %d: %s",
+		len(retried), strings.Join(retried, ", "), retries, *s.commitPipelineConfig(commit).InfraRetries, build.WebURL)
+	for _, c := range append([]Commit{commit}, others...) {
+		s.review(c.ChangeNumber, c.Patchset, Review{
+			Message: message,
+			Notify:  "NONE",
+		})
+	}
+	return true
+}
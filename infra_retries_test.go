@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestInfraFailureRetries(t *testing.T) {
+	state := setupTestState(t)
+
+	config, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {}}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+
+	var mu sync.Mutex
+	jobs := map[int]string{}
+	var retried []string
+	var reviews []ReviewInput
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var number int
+		var job string
+		switch {
+		case r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/a/changes/1234/revisions/"):
+			var input ReviewInput
+			json.NewDecoder(r.Body).Decode(&input)
+			reviews = append(reviews, input)
+		case r.Method == "PUT":
+			if _, err := fmt.Sscanf(r.URL.Path, "/v2/organizations/org/pipelines/ci/builds/%d/jobs/%s", &number, &job); err != nil {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			retried = append(retried, job)
+		default:
+			if _, err := fmt.Sscanf(r.URL.Path, "/v2/organizations/org/pipelines/ci/builds/%d", &number); err != nil {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			fmt.Fprintf(w, `{"number": %d, "jobs": [%s]}`, number, jobs[number])
+		}
+	}))
+	defer server.Close()
+
+	state.Project = "frc971"
+	state.Config = config
+	state.Buildkite = testBuildkiteClient(t, server)
+	state.BuildkiteOrganization = "org"
+	state.REST = NewGerritREST(server.URL, "buildkite", "secret")
+	state.ReviewTransport = ReviewOverREST
+	// Separate patchsets, so each build is the latest attempt.
+	for i, id := range []string{"lost", "broken", "canceled"} {
+		state.AddCommit(id, Commit{ChangeNumber: 1234, Patchset: i + 1, Project: "frc971", Pipeline: "ci", Number: i + 1})
+	}
+
+	finish := func(id string, number int, buildState string) ReviewInput {
+		commit, _ := state.GetCommit(id)
+		reviews = nil
+		state.reportBuildFinished(commit, nil, Build{ID: id, Number: number, State: buildState, WebURL: fmt.Sprintf("https://buildkite.com/%d", number)})
+		if len(reviews) != 1 {
+			t.Fatalf("expected one review for %s but got %v", id, reviews)
+		}
+		return reviews[0]
+	}
+
+	// A lost agent is retried once before giving up without a vote.
+	jobs[1] = `{"id": "j1", "type": "script", "name": "test", "state": "failed", "exit_status": -1}`
+	review := finish("lost", 1, "failed")
+	if len(retried) != 1 || retried[0] != "j1/retry" || review.Labels != nil || review.Message != "Retrying 1 jobs lost to infrastructure failures (test), attempt 1 of 1: https://buildkite.com/1" {
+		t.Fatalf("unexpected retry %v %#v", retried, review)
+	}
+	if commit, _ := state.GetCommit("lost"); commit.Retries != 1 || commit.State != "" {
+		t.Fatalf("expected the build to keep running but got %#v", commit)
+	}
+
+	jobs[1] = `{"id": "j1", "type": "script", "name": "test", "state": "failed", "exit_status": -1, "retried": true},
+		{"id": "j2", "type": "script", "name": "test", "state": "failed", "signal_reason": "agent_lost"}`
+	review = finish("lost", 1, "failed")
+	if len(retried) != 1 || review.Labels != nil || review.Message != "Build Lost to infrastructure failures: https://buildkite.com/1" {
+		t.Fatalf("unexpected result %v %#v", retried, review)
+	}
+	if commit, _ := state.GetCommit("lost"); commit.State != InfraFailed {
+		t.Fatalf("expected the build to be recorded as %s but got %q", InfraFailed, commit.State)
+	}
+
+	// Failures of the change itself vote straight away.
+	jobs[2] = `{"id": "j3", "type": "script", "name": "test", "state": "failed", "exit_status": 1},
+		{"id": "j4", "type": "script", "name": "lint", "state": "failed", "exit_status": -1}`
+	review = finish("broken", 2, "failed")
+	if len(retried) != 1 || review.Labels["Verified"] != -1 || review.Message != "Build Failed: https://buildkite.com/2" {
+		t.Fatalf("unexpected result %v %#v", retried, review)
+	}
+
+	// Cancellations are reported without a vote.
+	review = finish("canceled", 3, "canceled")
+	if review.Labels != nil || review.Message != "Build Canceled: https://buildkite.com/3" {
+		t.Fatalf("unexpected result %#v", review)
+	}
+}
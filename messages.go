@@ -0,0 +1,244 @@
+package main
+
+// Review messages posted on changes as their builds progress, rendered from per project templates.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"text/template"
+	"time"
+)
+
+// Build events which post a review message.
+const (
+	MessageStarted  = "started"
+	MessagePassed   = "passed"
+	MessageFailed   = "failed"
+	MessageCanceled = "canceled"
+	MessageBlocked  = "blocked"
+	MessageSkipped  = "skipped"
+	// The build failed because agents were lost, after retrying it infra_retries times.
+	MessageInfraFailed = "infra_failed"
+)
+
+// Templates used for the events a project doesn't configure.
+var defaultMessages = map[string]string{
+	MessageStarted:  defaultMessage("Started"),
+	MessagePassed:   defaultMessage("Succeeded"),
+	MessageFailed:   defaultMessage("Failed"),
+	MessageCanceled: defaultMessage("Canceled"),
+	MessageBlocked:  defaultMessage("Blocked"),
+	MessageSkipped:  defaultMessage("Skipped"),
+	// Not "Failed", it says nothing about the change.
+	MessageInfraFailed: defaultMessage("Lost to infrastructure failures"),
+}
+
+func defaultMessage(status string) string {
+	return "Build " + status + "{{if .Build.NonVoting}} in non-voting pipeline {{.Build.Pipeline}}{{end}}{{with .TopicChange}} with {{.}} in its topic{{end}}: {{.Build.URL}}" +
+		"{{with .Trailers}}\n\nAs asked for by the commit message:{{range .}}\n{{.}}{{end}}{{end}}"
+}
+
+// Data available to the message templates.
+type MessageTemplateData struct {
+	Change   *Change
+	PatchSet *PatchSet
+	// Number of the change which triggered a topic build, set when posting on the other changes in the topic.
+	TopicChange int
+	// CI-* trailers of the commit message, set when the build starts.
+	Trailers []Trailer
+	Build    MessageBuild
+}
+
+type MessageBuild struct {
+	URL      string
+	Number   int
+	Pipeline string
+	// True if the pipeline doesn't vote, and the message is only informational.
+	NonVoting bool
+	// Buildkite state of the build, empty when it starts.
+	State string
+	// How long the build ran for, zero until it finishes.
+	Duration time.Duration
+	// Names of the jobs which failed, and the number of jobs which were retried.  Only known once the build finishes.
+	FailedJobs []string
+	RetryCount int
+}
+
+// Example data used to check templates when the config is loaded.
+var exampleMessageTemplateData = MessageTemplateData{
+	Change:      exampleBuildTemplateData.Change,
+	PatchSet:    exampleBuildTemplateData.PatchSet,
+	TopicChange: 1235,
+	Trailers:    []Trailer{{Key: "CI-Pipelines", Value: "pipeline"}},
+	Build: MessageBuild{
+		URL:        "https://buildkite.com/organization/pipeline/builds/42",
+		Number:     42,
+		Pipeline:   "pipeline",
+		State:      "failed",
+		Duration:   5 * time.Minute,
+		FailedJobs: []string{"test"},
+		RetryCount: 1,
+	},
+}
+
+// Parses a message template and checks it renders with example data.
+func parseMessageTemplate(name string, text string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := renderMessageTemplate(t, exampleMessageTemplateData); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func renderMessageTemplate(t *template.Template, data MessageTemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Parses the configured message templates, filling in the defaults for the rest.
+func parseMessageTemplates(messages map[string]string) (map[string]*template.Template, error) {
+	result := map[string]*template.Template{}
+	for event, text := range messages {
+		if _, ok := defaultMessages[event]; !ok {
+			return nil, fmt.Errorf("unknown message event %q", event)
+		}
+		t, err := parseMessageTemplate(event, text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", event, err)
+		}
+		result[event] = t
+	}
+	for event, text := range defaultMessages {
+		if _, ok := result[event]; !ok {
+			result[event] = template.Must(parseMessageTemplate(event, text))
+		}
+	}
+	return result, nil
+}
+
+// Renders the message for a build event, falling back to the default template if the project's fails.
+func (p *ProjectConfig) renderMessage(event string, data MessageTemplateData) string {
+	if t, ok := p.messages[event]; ok {
+		message, err := renderMessageTemplate(t, data)
+		if err == nil {
+			return message
+		}
+		log.Printf("Failed to render %s message: %v", event, err)
+	}
+	t := template.Must(parseMessageTemplate(event, defaultMessages[event]))
+	message, err := renderMessageTemplate(t, data)
+	if err != nil {
+		log.Printf("Failed to render default %s message: %v", event, err)
+	}
+	return message
+}
+
+// Returns the message event for the state a finished build votes with.
+func finishedMessageEvent(state string) string {
+	switch state {
+	case "passed":
+		return MessagePassed
+	case "blocked":
+		return MessageBlocked
+	case "canceled", BuildCanceling:
+		return MessageCanceled
+	case "skipped", "not_run":
+		return MessageSkipped
+	case InfraFailed:
+		return MessageInfraFailed
+	default:
+		return MessageFailed
+	}
+}
+
+// Returns how long a build ran for from its Buildkite timestamps, or zero if they are missing.
+func buildDuration(build Build) time.Duration {
+	started, err := time.Parse(time.RFC3339, build.StartedAt)
+	if err != nil {
+		return 0
+	}
+	finished, err := time.Parse(time.RFC3339, build.FinishedAt)
+	if err != nil {
+		return 0
+	}
+	return finished.Sub(started)
+}
+
+// Returns the change and patchset a recorded build was for, with the fields the build itself records.
+func commitChange(commit Commit) (*Change, *PatchSet) {
+	change := &Change{
+		Project: commit.Project,
+		ID:      commit.ChangeId,
+		Number:  commit.ChangeNumber,
+	}
+	patchSet := &PatchSet{
+		Number:   commit.Patchset,
+		Revision: commit.Sha1,
+		Ref:      fmt.Sprintf("refs/changes/%02d/%d/%d", commit.ChangeNumber%100, commit.ChangeNumber, commit.Patchset),
+	}
+	return change, patchSet
+}
+
+// Returns the change and patchset a recorded build was for, with the fields remembered when the change was built.
+func (s *State) recordedChange(commit Commit) (*Change, *PatchSet) {
+	change, patchSet := commitChange(commit)
+	err := s.DB.QueryRow("select coalesce(branch, ''), coalesce(subject, ''), coalesce(url, ''), coalesce(ownername, ''), coalesce(owneremail, ''), coalesce(ownerusername, '') from changes where changenumber = ?", commit.ChangeNumber).Scan(
+		&change.Branch, &change.Subject, &change.URL, &change.Owner.Name, &change.Owner.Email, &change.Owner.Username)
+	if err != nil && err != sql.ErrNoRows {
+		log.Fatalf("Failed to query: '%v'", err)
+	}
+	return change, patchSet
+}
+
+// Remembers the fields of a change which finished messages can't get from its builds.
+func (s *State) RecordChange(change *Change) {
+	if _, err := s.DB.Exec("insert or replace into changes (changenumber, branch, subject, url, ownername, owneremail, ownerusername) values (?, ?, ?, ?, ?, ?, ?)",
+		change.Number, change.Branch, change.Subject, change.URL, change.Owner.Name, change.Owner.Email, change.Owner.Username); err != nil {
+		log.Fatalf("Failed to exec: %s", err)
+	}
+}
+
+// Asks Buildkite for the jobs of a finished build, or returns nil if we don't know where it ran or can't fetch them.
+func (s *State) finishedBuildJobs(commit Commit, build Build) *BuildkiteBuildJobs {
+	if s.Buildkite == nil || commit.Pipeline == "" || build.Number == 0 {
+		return nil
+	}
+	jobs, err := getBuildJobs(s.Buildkite, s.BuildkiteOrganization, commit.Pipeline, build.Number)
+	if err != nil {
+		log.Printf("Failed to fetch jobs of build %s: %v", build.ID, err)
+		return nil
+	}
+	return jobs
+}
+
+// Describes a finished build for the message templates, with its jobs if they are known.
+func (s *State) finishedMessageBuild(commit Commit, build Build, jobs *BuildkiteBuildJobs) MessageBuild {
+	result := MessageBuild{
+		URL:       build.WebURL,
+		Number:    build.Number,
+		Pipeline:  commit.Pipeline,
+		NonVoting: !*s.commitPipelineConfig(commit).Voting,
+		State:     build.State,
+		Duration:  buildDuration(build),
+	}
+	if jobs == nil {
+		return result
+	}
+	for _, job := range jobs.FailedJobs() {
+		result.FailedJobs = append(result.FailedJobs, job.Name)
+	}
+	for _, job := range jobs.Jobs {
+		if job.Retried {
+			result.RetryCount++
+		}
+	}
+	return result
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDefaultMessages(t *testing.T) {
+	config := (&State{}).projectConfig("frc971")
+	change, patchSet := commitChange(Commit{ChangeNumber: 1234, Patchset: 2})
+
+	type testCase struct {
+		event       string
+		topicChange int
+		expectation string
+	}
+
+	testCases := []testCase{
+		{
+			event:       MessageStarted,
+			expectation: "Build Started: https://buildkite.com/b/1",
+		},
+		{
+			event:       MessagePassed,
+			expectation: "Build Succeeded: https://buildkite.com/b/1",
+		},
+		{
+			event:       MessageFailed,
+			topicChange: 1235,
+			expectation: "Build Failed with 1235 in its topic: https://buildkite.com/b/1",
+		},
+		{
+			event:       MessageCanceled,
+			expectation: "Build Canceled: https://buildkite.com/b/1",
+		},
+		{
+			event:       MessageBlocked,
+			expectation: "Build Blocked: https://buildkite.com/b/1",
+		},
+	}
+
+	for id, tc := range testCases {
+		data := MessageTemplateData{
+			Change:      change,
+			PatchSet:    patchSet,
+			TopicChange: tc.topicChange,
+			Build:       MessageBuild{URL: "https://buildkite.com/b/1"},
+		}
+		if message := config.renderMessage(tc.event, data); message != tc.expectation {
+			t.Fatalf("expected %q for case %d but got %q", tc.expectation, id, message)
+		}
+	}
+}
+
+func TestConfiguredMessages(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {"messages": {
+		"failed": "{{.Change.Number}},{{.PatchSet.Number}} failed in {{.Build.Pipeline}} after {{.Build.Duration}} ({{.Build.RetryCount}} retries): {{range .Build.FailedJobs}}{{.}} {{end}}"
+	}}}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	state := &State{Project: "frc971", Config: config}
+
+	data := MessageTemplateData{Build: MessageBuild{
+		URL:        "https://buildkite.com/b/1",
+		Pipeline:   "ci",
+		Duration:   90 * time.Second,
+		FailedJobs: []string{"lint", "test"},
+		RetryCount: 2,
+	}}
+	data.Change, data.PatchSet = commitChange(Commit{ChangeNumber: 1234, Patchset: 2})
+
+	// Builds recorded without a project fall back to --project.
+	message := state.commitProjectConfig(Commit{}).renderMessage(MessageFailed, data)
+	if expected := "1234,2 failed in ci after 1m30s (2 retries): lint test "; message != expected {
+		t.Fatalf("expected %q but got %q", expected, message)
+	}
+	if message := state.projectConfig("frc971").renderMessage(MessagePassed, data); message != "Build Succeeded: https://buildkite.com/b/1" {
+		t.Fatalf("expected the default passed message but got %q", message)
+	}
+}
+
+// Finished messages only have the build, so the rest of the change comes from when it was built.
+func TestRecordedChangeMessages(t *testing.T) {
+	state := setupTestState(t)
+
+	config, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {"messages": {
+		"passed": "{{.Change.Subject}} on {{.Change.Branch}} by {{.Change.Owner.Name}} passed: {{.Change.URL}}"
+	}}}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	state.Project = "frc971"
+	state.Config = config
+	state.RecordChange(&Change{Number: 1234, Branch: "main", Subject: "Fix the arm", URL: "https://gerrit/c/1234", Owner: User{Name: "Jane"}})
+
+	data := MessageTemplateData{Build: MessageBuild{URL: "https://buildkite.com/b/1"}}
+	data.Change, data.PatchSet = state.recordedChange(Commit{ChangeNumber: 1234, Patchset: 2, Project: "frc971"})
+	if message := state.projectConfig("frc971").renderMessage(MessagePassed, data); message != "Fix the arm on main by Jane passed: https://gerrit/c/1234" {
+		t.Fatalf("unexpected message %q", message)
+	}
+	if data.PatchSet.Number != 2 || data.Change.Number != 1234 {
+		t.Fatalf("unexpected change %#v %#v", data.Change, data.PatchSet)
+	}
+
+	if change, _ := state.recordedChange(Commit{ChangeNumber: 1235, Patchset: 1}); change.Subject != "" || change.Number != 1235 {
+		t.Fatalf("expected changes we never built to only have what the build records but got %#v", change)
+	}
+}
+
+func TestInvalidMessages(t *testing.T) {
+	for id, contents := range []string{
+		`{"projects": {"frc971": {"messages": {"finished": "Done"}}}}`,
+		`{"projects": {"frc971": {"messages": {"passed": "{{.Build.URL"}}}}`,
+		`{"projects": {"frc971": {"messages": {"passed": "{{.Build.Link}}"}}}}`,
+	} {
+		if _, err := LoadConfig(writeConfig(t, contents)); err == nil {
+			t.Fatalf("expected case %d to be rejected", id)
+		}
+	}
+}
+
+func TestFinishedMessageEvent(t *testing.T) {
+	type testCase struct {
+		build       Build
+		expectation string
+	}
+
+	testCases := []testCase{
+		{build: Build{State: "passed"}, expectation: MessagePassed},
+		{build: Build{State: "failed"}, expectation: MessageFailed},
+		{build: Build{State: "canceled"}, expectation: MessageCanceled},
+		{build: Build{State: "blocked"}, expectation: MessageBlocked},
+		{build: Build{State: "passed", Blocked: true}, expectation: MessageBlocked},
+		{build: Build{State: "canceling"}, expectation: MessageCanceled},
+		{build: Build{State: "skipped"}, expectation: MessageSkipped},
+		{build: Build{State: "not_run"}, expectation: MessageSkipped},
+	}
+
+	for id, tc := range testCases {
+		if event := finishedMessageEvent(buildVoteState(tc.build)); event != tc.expectation {
+			t.Fatalf("expected %s for case %d but got %s", tc.expectation, id, event)
+		}
+	}
+
+	duration := buildDuration(Build{StartedAt: "2024-01-02T03:04:05.123Z", FinishedAt: "2024-01-02T03:06:05.123Z"})
+	if duration != 2*time.Minute {
+		t.Fatalf("expected a 2m build but got %s", duration)
+	}
+	if duration := buildDuration(Build{StartedAt: "2024-01-02T03:04:05Z"}); duration != 0 {
+		t.Fatalf("expected no duration for an unfinished build but got %s", duration)
+	}
+}
+
+func TestGerritRESTReview(t *testing.T) {
+	var input ReviewInput
+	submitted := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /a/changes/1234/revisions/2/review":
+			json.NewDecoder(r.Body).Decode(&input)
+		case "POST /a/changes/1234/submit":
+			submitted = true
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	state := &State{REST: NewGerritREST(server.URL, "buildkite", "secret"), ReviewTransport: ReviewOverREST}
+	message := "Build Failed: it's 'quoted'\nand multi-line"
+	if err := state.review(1234, 2, Review{Message: message, Notify: "NONE", Labels: map[string]string{"Verified": "-1"}, Submit: true}); err != nil {
+		t.Fatalf("failed to review: %s", err)
+	}
+	if input.Message != message || input.Notify != "NONE" || input.Labels["Verified"] != -1 || !submitted {
+		t.Fatalf("unexpected review %#v, submitted %v", input, submitted)
+	}
+
+	if err := state.review(1, 1, Review{Message: "missing"}); err == nil {
+		t.Fatalf("expected an error for a missing change")
+	}
+}
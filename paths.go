@@ -0,0 +1,194 @@
+package main
+
+// Selecting the pipelines to build a patchset in from the files it changes.
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// A pipeline which isn't built for a patchset, and why.
+type SkippedPipeline struct {
+	Pipeline string
+	Reason   string
+}
+
+// Compiles a glob into a regular expression matching whole paths.  "**" matches anything, "*" anything but "/", and "?" a single character other than "/".
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					// "**/" also matches no directories at all.
+					i++
+					re.WriteString("(.*/)?")
+				} else {
+					re.WriteString(".*")
+				}
+			} else {
+				re.WriteString("[^/]*")
+			}
+		case '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+func compileGlobs(patterns []string) ([]*regexp.Regexp, error) {
+	var result []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := compileGlob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", pattern, err)
+		}
+		result = append(result, re)
+	}
+	return result, nil
+}
+
+func matchesAny(patterns []*regexp.Regexp, file string) bool {
+	for _, re := range patterns {
+		if re.MatchString(file) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the pipeline only builds patchsets changing some files.
+func (p *PipelineConfig) filtersFiles() bool {
+	return len(p.include) > 0 || len(p.exclude) > 0
+}
+
+// Returns an empty string if the pipeline should build a patchset changing files, or why not.
+// A file counts if it matches an include pattern, or there are none, and no exclude pattern.
+func (p *PipelineConfig) fileSkipReason(files []string) string {
+	included := 0
+	for _, file := range files {
+		if len(p.include) > 0 && !matchesAny(p.include, file) {
+			continue
+		}
+		included++
+		if !matchesAny(p.exclude, file) {
+			return ""
+		}
+	}
+	if len(files) == 0 {
+		return "no files changed"
+	}
+	if included == 0 {
+		return fmt.Sprintf("none of the changed files match %s", strings.Join(p.Include, ", "))
+	}
+	return fmt.Sprintf("all the changed files match %s", strings.Join(p.Exclude, ", "))
+}
+
+// Returns the files changed by a patchset, without gerrit's magic files like /COMMIT_MSG.
+func (s *State) patchSetFiles(changeNumber int, patchset int) ([]string, error) {
+	changes, err := s.query(fmt.Sprintf("change:%d", changeNumber), "--patch-sets", "--files")
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		for _, ps := range change.PatchSets {
+			if ps.Number != patchset {
+				continue
+			}
+			var result []string
+			for _, file := range ps.Files {
+				if strings.HasPrefix(file.File, "/") {
+					continue
+				}
+				result = append(result, file.File)
+			}
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("patchset %d,%d not found", changeNumber, patchset)
+}
+
+// Splits pipelines into the ones which should build the files a patchset changes, and the ones which shouldn't.
+func (s *State) selectPipelines(change *Change, patchSet *PatchSet, pipelines []string) ([]string, []SkippedPipeline) {
+	filtered := false
+	for _, pipeline := range pipelines {
+		if s.pipelineConfig(change.Project, pipeline).filtersFiles() {
+			filtered = true
+		}
+	}
+	if !filtered {
+		return pipelines, nil
+	}
+
+	files, err := s.patchSetFiles(change.Number, patchSet.Number)
+	if err != nil {
+		log.Printf("Failed to list the files of %d,%d, building in every pipeline: %v", change.Number, patchSet.Number, err)
+		return pipelines, nil
+	}
+
+	var build []string
+	var skipped []SkippedPipeline
+	for _, pipeline := range pipelines {
+		if reason := s.pipelineConfig(change.Project, pipeline).fileSkipReason(files); reason != "" {
+			skipped = append(skipped, SkippedPipeline{Pipeline: pipeline, Reason: reason})
+		} else {
+			build = append(build, pipeline)
+		}
+	}
+	return build, skipped
+}
+
+// Returns the passing votes of the labels which are only voted on by skipped pipelines, since there is nothing for them to check.
+func (s *State) skippedPipelineVotes(project string, built []string, skipped []SkippedPipeline) map[string]string {
+	builtLabels := map[string]bool{}
+	for _, pipeline := range built {
+		if config := s.pipelineConfig(project, pipeline); *config.Voting {
+			builtLabels[config.Label] = true
+		}
+	}
+
+	var result map[string]string
+	for _, skip := range skipped {
+		config := s.pipelineConfig(project, skip.Pipeline)
+		if builtLabels[config.Label] {
+			continue
+		}
+		for label, value := range config.vote("passed") {
+			if result == nil {
+				result = map[string]string{}
+			}
+			result[label] = value
+		}
+	}
+	return result
+}
+
+// Tells the change which pipelines aren't building it, and votes for the labels nothing is building.
+func (s *State) reportSkippedPipelines(change *Change, patchSet *PatchSet, built []string, skipped []SkippedPipeline) {
+	var lines []string
+	for _, skip := range skipped {
+		lines = append(lines, fmt.Sprintf(" * %s: %s", skip.Pipeline, skip.Reason))
+	}
+
+	review := Review{
+		Notify: "NONE",
+		Labels: s.skippedPipelineVotes(change.Project, built, skipped),
+	}
+	if len(built) == 0 {
+		review.Message = "No pipelines applicable to the changed files:\n" + strings.Join(lines, "\n")
+	} else {
+		review.Message = "Not building in:\n" + strings.Join(lines, "\n")
+	}
+	s.review(change.Number, patchSet.Number, review)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCompileGlob(t *testing.T) {
+	type testCase struct {
+		pattern     string
+		file        string
+		expectation bool
+	}
+
+	testCases := []testCase{
+		{pattern: "README.md", file: "README.md", expectation: true},
+		{pattern: "*.md", file: "README.md", expectation: true},
+		{pattern: "*.md", file: "docs/index.md", expectation: false},
+		{pattern: "**/*.md", file: "docs/index.md", expectation: true},
+		{pattern: "**/*.md", file: "README.md", expectation: true},
+		{pattern: "docs/**", file: "docs/a/b.png", expectation: true},
+		{pattern: "docs/**", file: "src/docs/a.png", expectation: false},
+		{pattern: "src/?.c", file: "src/a.c", expectation: true},
+		{pattern: "src/?.c", file: "src/ab.c", expectation: false},
+		// Regexp syntax is literal
+		{pattern: "a+b.txt", file: "a+b.txt", expectation: true},
+		{pattern: "a+b.txt", file: "aab.txt", expectation: false},
+	}
+
+	for id, tc := range testCases {
+		re, err := compileGlob(tc.pattern)
+		if err != nil {
+			t.Fatalf("failed to compile case %d: %s", id, err)
+		}
+		if matched := re.MatchString(tc.file); matched != tc.expectation {
+			t.Fatalf("expected %v for case %d but got %v", tc.expectation, id, matched)
+		}
+	}
+}
+
+func TestPipelineFileFilters(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {
+		"verify_pipelines": ["linux", "docs"],
+		"pipelines": {
+			"linux": {"exclude": ["**/*.md", "docs/**"]},
+			"docs": {"label": "Docs-Verified", "include": ["docs/**", "**/*.md"]}
+		}
+	}}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	state := &State{Project: "frc971", Config: config}
+	linux := state.pipelineConfig("frc971", "linux")
+	docs := state.pipelineConfig("frc971", "docs")
+
+	type testCase struct {
+		files []string
+		linux bool
+		docs  bool
+	}
+
+	testCases := []testCase{
+		{files: []string{"README.md"}, linux: false, docs: true},
+		{files: []string{"src/main.cc"}, linux: true, docs: false},
+		{files: []string{"src/main.cc", "docs/index.html"}, linux: true, docs: true},
+		{files: []string{}, linux: false, docs: false},
+	}
+
+	for id, tc := range testCases {
+		if built := linux.fileSkipReason(tc.files) == ""; built != tc.linux {
+			t.Fatalf("expected linux %v for case %d but got %v", tc.linux, id, built)
+		}
+		if built := docs.fileSkipReason(tc.files) == ""; built != tc.docs {
+			t.Fatalf("expected docs %v for case %d but got %v", tc.docs, id, built)
+		}
+	}
+
+	if reason := docs.fileSkipReason([]string{"src/main.cc"}); reason != "none of the changed files match docs/**, **/*.md" {
+		t.Fatalf("unexpected reason %q", reason)
+	}
+	if reason := linux.fileSkipReason([]string{"README.md"}); reason != "all the changed files match **/*.md, docs/**" {
+		t.Fatalf("unexpected reason %q", reason)
+	}
+
+	// Only labels nothing builds get voted on when pipelines are skipped.
+	skipped := []SkippedPipeline{{Pipeline: "docs", Reason: "none"}}
+	if labels := state.skippedPipelineVotes("frc971", []string{"linux"}, skipped); len(labels) != 1 || labels["Docs-Verified"] != "+1" {
+		t.Fatalf("unexpected votes %v", labels)
+	}
+	skipped = []SkippedPipeline{{Pipeline: "linux", Reason: "none"}}
+	if labels := state.skippedPipelineVotes("frc971", []string{"docs"}, skipped); len(labels) != 1 || labels["Verified"] != "+1" {
+		t.Fatalf("unexpected votes %v", labels)
+	}
+	if labels := state.skippedPipelineVotes("frc971", []string{"linux"}, nil); labels != nil {
+		t.Fatalf("expected no votes but got %v", labels)
+	}
+
+	if _, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {"pipelines": {"docs": {"include": [""]}}}}}`)); err == nil {
+		t.Fatalf("expected empty patterns to be rejected")
+	}
+}
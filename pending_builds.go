@@ -0,0 +1,79 @@
+package main
+
+// Builds being created, so a webhook which arrives before Builds.Create returns can still be matched to what it built.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+// Meta-data key holding the token a build was created with.
+const BuildTokenKey = "gerrit-buildkite-token"
+
+type pendingBuild struct {
+	once   sync.Once
+	record func(build *buildkite.Build)
+}
+
+// Builds we asked Buildkite to create, keyed by the token in their meta-data.  The zero value is ready to use.
+type PendingBuilds struct {
+	mu     sync.Mutex
+	builds map[string]*pendingBuild
+}
+
+// Registers a build about to be created, returning the token to create it with.
+// record is called once with the build, by whichever of Builds.Create or its first webhook sees it first.
+func (p *PendingBuilds) Add(record func(build *buildkite.Build)) string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Fatalf("Failed to generate a build token: %v", err)
+	}
+	token := hex.EncodeToString(b[:])
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.builds == nil {
+		p.builds = map[string]*pendingBuild{}
+	}
+	p.builds[token] = &pendingBuild{record: record}
+	return token
+}
+
+// Records the build created with a token, if it is still pending and hasn't been recorded yet.
+// Returns once the build is recorded, even if another caller is recording it, and true if this call recorded it.
+func (p *PendingBuilds) Record(token string, build *buildkite.Build) bool {
+	p.mu.Lock()
+	pending, ok := p.builds[token]
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+	recorded := false
+	pending.once.Do(func() {
+		pending.record(build)
+		recorded = true
+	})
+	return recorded
+}
+
+// Forgets a token once Builds.Create has returned and the build is recorded, or failed.
+func (p *PendingBuilds) Remove(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.builds, token)
+}
+
+// Records the build in a webhook if it was created with a token which is still pending.
+func (s *State) recordPendingBuild(build Build) {
+	token := build.MetaData[BuildTokenKey]
+	if token == "" {
+		return
+	}
+	if s.pending.Record(token, &buildkite.Build{ID: &build.ID, Number: &build.Number, WebURL: &build.WebURL}) {
+		log.Printf("Recorded build %s from its webhook before Buildkite answered the create", build.ID)
+	}
+}
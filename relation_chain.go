@@ -0,0 +1,173 @@
+package main
+
+// Building stacked changes with the context of the open changes they sit on.
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+// Returns the open changes a commit sits on, closest parent first.
+// Each ancestor is followed through its current patchset, so the chain describes the stack as it is now,
+// even if the commit was uploaded on top of an older patchset of its parent.
+func relationChain(parents []string, number int, open []QueryChange) []QueryChange {
+	// Map every patchset of every open change back to its change.
+	byRevision := map[string]int{}
+	for i, change := range open {
+		for _, patchSet := range change.PatchSets {
+			byRevision[patchSet.Revision] = i
+		}
+		if change.CurrentPatchSet != nil {
+			byRevision[change.CurrentPatchSet.Revision] = i
+		}
+	}
+
+	var chain []QueryChange
+	seen := map[int]bool{number: true}
+	for len(parents) > 0 {
+		i, ok := byRevision[parents[0]]
+		if !ok {
+			break
+		}
+		parent := open[i]
+		// Protect against a corrupt graph sending us around in circles.
+		if seen[parent.Number] || parent.CurrentPatchSet == nil {
+			break
+		}
+		seen[parent.Number] = true
+		chain = append(chain, parent)
+		parents = parent.CurrentPatchSet.Parents
+	}
+	return chain
+}
+
+// Returns the open changes which sit on top of the provided change, directly or indirectly.
+func descendants(number int, open []QueryChange) []QueryChange {
+	var result []QueryChange
+	for _, change := range open {
+		if change.Number == number || change.CurrentPatchSet == nil {
+			continue
+		}
+		for _, ancestor := range relationChain(change.CurrentPatchSet.Parents, change.Number, open) {
+			if ancestor.Number == number {
+				result = append(result, change)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Returns the environment describing the chain of open changes a build sits on.
+func chainEnv(patchSet *PatchSet, chain []QueryChange) map[string]string {
+	var numbers, refs []string
+	outdated := false
+	for i, change := range chain {
+		numbers = append(numbers, fmt.Sprintf("%d", change.Number))
+		refs = append(refs, change.CurrentPatchSet.Ref)
+
+		// The build is out of date if it doesn't sit directly on the current patchset of its parent.
+		parents := patchSet.Parents
+		if i > 0 {
+			parents = chain[i-1].CurrentPatchSet.Parents
+		}
+		if len(parents) == 0 || parents[0] != change.CurrentPatchSet.Revision {
+			outdated = true
+		}
+	}
+	return map[string]string{
+		"GERRIT_CHAIN_CHANGES":  strings.Join(numbers, " "),
+		"GERRIT_CHAIN_REFS":     strings.Join(refs, " "),
+		"GERRIT_CHAIN_OUTDATED": fmt.Sprintf("%t", outdated),
+	}
+}
+
+// Returns the open changes on the same project and branch as the change.
+func (s *State) openChanges(change *Change) ([]QueryChange, error) {
+	return s.query(fmt.Sprintf("status:open project:%s branch:%s", change.Project, change.Branch), "--current-patch-set", "--patch-sets")
+}
+
+// Returns the relation chain environment for a build of the patchset in the event, if the project builds chains.
+func (s *State) relationChainEnv(eventInfo EventInfo) map[string]string {
+	if !s.projectConfig(eventInfo.Change.Project).BuildChains {
+		return nil
+	}
+
+	open, err := s.openChanges(eventInfo.Change)
+	if err != nil {
+		log.Printf("Failed to find the relation chain of %d: %v", eventInfo.Change.Number, err)
+		return nil
+	}
+	chain := relationChain(eventInfo.PatchSet.Parents, eventInfo.Change.Number, open)
+	if len(chain) == 0 {
+		return nil
+	}
+	log.Printf("Change %d sits on %d open changes", eventInfo.Change.Number, len(chain))
+	return chainEnv(eventInfo.PatchSet, chain)
+}
+
+// Rebuilds the open changes stacked on top of the change in the event, so their vote reflects its new patchset.
+func (s *State) rebuildDescendants(eventInfo EventInfo, client *buildkite.Client) {
+	if !s.watchesProject(eventInfo.Project) || eventInfo.Change == nil || eventInfo.PatchSet == nil {
+		return
+	}
+	if !s.projectConfig(eventInfo.Change.Project).RebuildDescendants {
+		return
+	}
+	// A new commit message doesn't change what the descendants build.
+	if eventInfo.PatchSet.Kind == "NO_CODE_CHANGE" {
+		return
+	}
+
+	open, err := s.openChanges(eventInfo.Change)
+	if err != nil {
+		log.Printf("Failed to find the descendants of %d: %v", eventInfo.Change.Number, err)
+		return
+	}
+
+	for _, change := range s.staleDescendants(eventInfo, open) {
+		descendant := change.Change
+		if reason := s.skipReason(&descendant); reason != "" {
+			log.Printf("Not rebuilding descendant %d, the change is %s", descendant.Number, reason)
+			continue
+		}
+
+		patchSet := *change.CurrentPatchSet
+		descendantEvent := EventInfo{
+			Type:     eventInfo.Type,
+			Project:  descendant.Project,
+			Change:   &descendant,
+			PatchSet: &patchSet,
+			Uploader: &patchSet.Uploader,
+		}
+		if !s.authorizedUser(descendantEvent) {
+			continue
+		}
+
+		log.Printf("Rebuilding %d,%d since its parent %d has a new patchset", descendant.Number, patchSet.Number, eventInfo.Change.Number)
+		s.handleEvent(descendantEvent, client)
+	}
+}
+
+// Returns the descendants of the patchset in the event which were built on an older patchset of it.  Descendants
+// uploaded in the same push, or whose current patchset hasn't been built yet, are built by their own patchset-created
+// events, so rebuilding them too would build a pushed stack over and over.
+func (s *State) staleDescendants(eventInfo EventInfo, open []QueryChange) []QueryChange {
+	var result []QueryChange
+	for _, change := range descendants(eventInfo.Change.Number, open) {
+		patchSet := change.CurrentPatchSet
+		if patchSet.CreatedOn == eventInfo.PatchSet.CreatedOn && patchSet.Uploader.Username == eventInfo.PatchSet.Uploader.Username {
+			log.Printf("Not rebuilding descendant %d,%d, it was pushed along with %d", change.Number, patchSet.Number, eventInfo.Change.Number)
+			continue
+		}
+		if _, _, ok := s.GetLatestPatchsetBuild(change.Number, patchSet.Number); !ok {
+			log.Printf("Not rebuilding descendant %d,%d, it hasn't been built yet", change.Number, patchSet.Number)
+			continue
+		}
+		result = append(result, change)
+	}
+	return result
+}
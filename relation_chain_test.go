@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Builds an open change whose patchsets have the provided revisions and parents.  The last patchset is current.
+func openChange(number int, patchSets ...PatchSet) QueryChange {
+	for i := range patchSets {
+		patchSets[i].Number = i + 1
+		patchSets[i].Ref = refName(number, i+1)
+	}
+	current := patchSets[len(patchSets)-1]
+	return QueryChange{
+		Change:          Change{Number: number, Project: "p", Branch: "main"},
+		Open:            true,
+		CurrentPatchSet: &current,
+		PatchSets:       patchSets,
+	}
+}
+
+func refName(number int, patchset int) string {
+	return fmt.Sprintf("refs/changes/%02d/%d/%d", number%100, number, patchset)
+}
+
+func changeNumbers(changes []QueryChange) []int {
+	result := []int{}
+	for _, change := range changes {
+		result = append(result, change.Number)
+	}
+	return result
+}
+
+func TestRelationChain(t *testing.T) {
+	// 1 <- 2 <- 3 where 3 was uploaded on patchset 1 of 2, and 2 has since been rebased.
+	// 4 sits directly on the branch.
+	open := []QueryChange{
+		openChange(1, PatchSet{Revision: "a1", Parents: []string{"main"}}),
+		openChange(2, PatchSet{Revision: "b1", Parents: []string{"a1"}}, PatchSet{Revision: "b2", Parents: []string{"a1"}}),
+		openChange(3, PatchSet{Revision: "c1", Parents: []string{"b1"}}),
+		openChange(4, PatchSet{Revision: "d1", Parents: []string{"main"}}),
+	}
+
+	type testCase struct {
+		parents []string
+		number  int
+		chain   []int
+	}
+
+	testCases := []testCase{
+		{parents: []string{"main"}, number: 1, chain: []int{}},
+		{parents: []string{"a1"}, number: 2, chain: []int{1}},
+		{parents: []string{"b1"}, number: 3, chain: []int{2, 1}},
+		{parents: []string{"b2"}, number: 3, chain: []int{2, 1}},
+		{parents: []string{"main"}, number: 4, chain: []int{}},
+		// A new change on top of the whole stack
+		{parents: []string{"c1"}, number: 5, chain: []int{3, 2, 1}},
+	}
+
+	for id, tc := range testCases {
+		if chain := changeNumbers(relationChain(tc.parents, tc.number, open)); !reflect.DeepEqual(chain, tc.chain) {
+			t.Errorf("expected chain %v for case %d but got %v", tc.chain, id, chain)
+		}
+	}
+
+	if d := changeNumbers(descendants(1, open)); !reflect.DeepEqual(d, []int{2, 3}) {
+		t.Errorf("expected descendants [2 3] of 1 but got %v", d)
+	}
+	if d := changeNumbers(descendants(2, open)); !reflect.DeepEqual(d, []int{3}) {
+		t.Errorf("expected descendants [3] of 2 but got %v", d)
+	}
+	if d := changeNumbers(descendants(4, open)); !reflect.DeepEqual(d, []int{}) {
+		t.Errorf("expected no descendants of 4 but got %v", d)
+	}
+
+	// 3 sits on an old patchset of 2, so its build is out of date.
+	env := chainEnv(open[2].CurrentPatchSet, relationChain([]string{"b1"}, 3, open))
+	expected := map[string]string{
+		"GERRIT_CHAIN_CHANGES":  "2 1",
+		"GERRIT_CHAIN_REFS":     refName(2, 2) + " " + refName(1, 1),
+		"GERRIT_CHAIN_OUTDATED": "true",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("expected env %v but got %v", expected, env)
+	}
+
+	env = chainEnv(open[1].CurrentPatchSet, relationChain([]string{"a1"}, 2, open))
+	if env["GERRIT_CHAIN_OUTDATED"] != "false" {
+		t.Errorf("expected 2 to be up to date but got %v", env)
+	}
+}
+
+func TestRebuildDescendants(t *testing.T) {
+	state := setupTestState(t)
+	state.Project = "p"
+
+	austin := User{Username: "austin"}
+	// 1 <- 2 <- 3 pushed together.
+	open := []QueryChange{
+		openChange(1, PatchSet{Revision: "a1", Parents: []string{"main"}, Uploader: austin, CreatedOn: 100}),
+		openChange(2, PatchSet{Revision: "b1", Parents: []string{"a1"}, Uploader: austin, CreatedOn: 100}),
+		openChange(3, PatchSet{Revision: "c1", Parents: []string{"b1"}, Uploader: austin, CreatedOn: 100}),
+	}
+
+	// Handles the patchset-created event of every change, building it and its stale descendants, and returns how many
+	// builds that took.
+	total := 0
+	push := func(numbers ...int) int {
+		builds := 0
+		for _, number := range numbers {
+			change := open[number-1]
+			eventInfo := EventInfo{Project: "p", Change: &change.Change, PatchSet: change.CurrentPatchSet}
+			for _, built := range append([]QueryChange{change}, state.staleDescendants(eventInfo, open)...) {
+				total++
+				state.AddCommit(fmt.Sprintf("build-%d", total), Commit{
+					ChangeNumber: built.Number,
+					Patchset:     built.CurrentPatchSet.Number,
+					Project:      "p",
+					Pipeline:     "ci",
+				})
+				builds++
+			}
+		}
+		return builds
+	}
+
+	if builds := push(1, 2, 3); builds != 3 {
+		t.Fatalf("expected a pushed stack of 3 changes to take 3 builds but got %d", builds)
+	}
+
+	// Rebasing the bottom of the stack on its own rebuilds the rest.
+	open[0] = openChange(1, PatchSet{Revision: "a1", Parents: []string{"main"}}, PatchSet{Revision: "a2", Parents: []string{"main2"}, Uploader: austin, CreatedOn: 200})
+	if builds := push(1); builds != 3 {
+		t.Fatalf("expected the descendants to be rebuilt but got %d builds", builds)
+	}
+}
+
+func TestParseQueryResults(t *testing.T) {
+	out := []byte(`{"project":"p","branch":"main","id":"I1","number":1,"open":true,"lastUpdated":1,"currentPatchSet":{"number":2,"revision":"a2","parents":["main"],"ref":"refs/changes/01/1/2"}}
+{"type":"stats","rowCount":1,"runTimeMilliseconds":5,"moreChanges":false}
+`)
+	changes, err := parseQueryResults(out)
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if len(changes) != 1 || changes[0].Number != 1 || changes[0].CurrentPatchSet.Revision != "a2" || !changes[0].Open {
+		t.Fatalf("unexpected results %#v", changes)
+	}
+
+	if _, err := parseQueryResults([]byte(`{"type":"error","message":"bad query"}`)); err == nil {
+		t.Fatalf("expected an error row to fail")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+// Proposing reverts of changes which broke a branch build.
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Returns the revert proposed for a change, if any.
+func (s *State) GetRevert(changeNumber int) (int, bool) {
+	var revert int
+	err := s.DB.QueryRow("select revert from reverts where changenumber = ?", changeNumber).Scan(&revert)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Fatalf("Failed to query: '%v'", err)
+		}
+		return 0, false
+	}
+	return revert, true
+}
+
+func (s *State) AddRevert(changeNumber int, revert int) {
+	if _, err := s.DB.Exec("insert or replace into reverts (changenumber, revert) values (?, ?)", changeNumber, revert); err != nil {
+		log.Fatalf("Failed to exec: %s", err)
+	}
+}
+
+// Proposes a revert of a merged change which broke the build, if the project allows it.
+// The revert is tagged with the project's hashtag, verified, and linked from the original change.
+func (s *State) proposeRevert(project string, culprit MergedChange, reason string) {
+	config := s.projectConfig(project)
+	if !config.AutoRevert {
+		return
+	}
+
+	// Hold the culprit's lock from checking for an earlier revert until the new one is recorded, so two failed builds
+	// blaming it at once can't both revert it.
+	unlock := s.changes.Lock(culprit.Number)
+	change, ok := s.createRevert(config, culprit, reason)
+	unlock()
+	if !ok {
+		return
+	}
+	log.Printf("Proposed %d reverting %d", change.Number, culprit.Number)
+
+	if err := s.REST.AddHashtags(change.Number, config.RevertHashtag); err != nil {
+		log.Printf("Failed to tag revert %d: %v", change.Number, err)
+	}
+
+	s.review(culprit.Number, culprit.Patchset, Review{
+		Message: fmt.Sprintf("%s\n\nProposed a revert: %s", reason, s.REST.ChangeURL(change.Number)),
+	})
+
+	// Gerrit creates the revert as us, and we don't build our own uploads from patchset-created, so verify it here.
+	current, err := s.REST.GetChange(change.Number)
+	if err != nil {
+		log.Printf("Failed to look up revert %d: %v", change.Number, err)
+		return
+	}
+	revision, ok := current.Revisions[current.CurrentRevision]
+	if !ok {
+		log.Printf("Revert %d has no current revision", change.Number)
+		return
+	}
+	s.handleEvent(EventInfo{
+		Type:    "patchset-created",
+		Project: current.Project,
+		Change: &Change{
+			Project:  current.Project,
+			Branch:   current.Branch,
+			ID:       current.ChangeId,
+			Number:   current.Number,
+			Subject:  current.Subject,
+			URL:      s.REST.ChangeURL(current.Number),
+			Hashtags: []string{config.RevertHashtag},
+		},
+		PatchSet: &PatchSet{
+			Number:   revision.Number,
+			Revision: current.CurrentRevision,
+			Ref:      revision.Ref,
+		},
+		Uploader: &User{Name: s.User, Username: s.User},
+	}, s.Buildkite)
+}
+
+// Creates and records the revert of a change, unless it was already reverted or the project is in dry run mode.
+// Returns false if no revert was created.  The change needs to be locked.
+func (s *State) createRevert(config *ProjectConfig, culprit MergedChange, reason string) (*ChangeInfo, bool) {
+	if revert, ok := s.GetRevert(culprit.Number); ok {
+		log.Printf("Change %d was already reverted by %d", culprit.Number, revert)
+		return nil, false
+	}
+
+	if config.RevertDryRun {
+		log.Printf("Dry run, not reverting %d: %s", culprit.Number, reason)
+		s.review(culprit.Number, culprit.Patchset, Review{
+			Message: fmt.Sprintf("Would propose a revert of this change, but reverts are in dry run mode: %s", reason),
+			Notify:  "NONE",
+		})
+		return nil, false
+	}
+
+	if s.REST == nil {
+		log.Printf("Can't revert %d without --gerrit_url", culprit.Number)
+		return nil, false
+	}
+
+	change, err := s.REST.Revert(culprit.Number, fmt.Sprintf("Revert \"%s\"\n\nThis reverts commit %s.\n\n%s", culprit.Subject, culprit.Revision, reason))
+	if err != nil {
+		log.Printf("Failed to revert %d: %v", culprit.Number, err)
+		s.review(culprit.Number, culprit.Patchset, Review{
+			Message: fmt.Sprintf("Failed to propose a revert of this change: %v", err),
+		})
+		return nil, false
+	}
+	s.AddRevert(culprit.Number, change.Number)
+	return change, true
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGerritRESTRevert(t *testing.T) {
+	var hashtags map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "buildkite" || password != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "POST /a/changes/1234/revert":
+			var input map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input["message"] == "" {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			io.WriteString(w, ")]}'\n{\"id\": \"p~main~I5\", \"project\": \"p\", \"branch\": \"main\", \"change_id\": \"I5\", \"_number\": 1240}")
+		case "POST /a/changes/1240/hashtags":
+			json.NewDecoder(r.Body).Decode(&hashtags)
+			io.WriteString(w, ")]}'\n[\"ci-revert\"]")
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	rest := NewGerritREST(server.URL+"/", "buildkite", "secret")
+	change, err := rest.Revert(1234, "Revert \"Broke it\"")
+	if err != nil {
+		t.Fatalf("failed to revert: %s", err)
+	}
+	if change.Number != 1240 || change.ChangeId != "I5" || change.Project != "p" {
+		t.Fatalf("unexpected revert %#v", change)
+	}
+	if err := rest.AddHashtags(change.Number, "ci-revert"); err != nil {
+		t.Fatalf("failed to add hashtags: %s", err)
+	}
+	if len(hashtags["add"]) != 1 || hashtags["add"][0] != "ci-revert" {
+		t.Fatalf("unexpected hashtags %v", hashtags)
+	}
+	if url := rest.ChangeURL(1240); url != server.URL+"/1240" {
+		t.Fatalf("unexpected change URL %s", url)
+	}
+
+	if _, err := rest.Revert(1, "Revert"); err == nil {
+		t.Fatalf("expected an error for a missing change")
+	}
+}
+
+func TestRevertsRecorded(t *testing.T) {
+	state := setupTestState(t)
+
+	if _, ok := state.GetRevert(1234); ok {
+		t.Fatalf("expected no revert")
+	}
+	state.AddRevert(1234, 1240)
+	if revert, ok := state.GetRevert(1234); !ok || revert != 1240 {
+		t.Fatalf("expected revert 1240 but got %d %v", revert, ok)
+	}
+}
+
+func TestProposeRevertOnce(t *testing.T) {
+	state := setupTestState(t)
+
+	config, err := LoadConfig(writeConfig(t, `{"projects": {"p": {"auto_revert": true}}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	if err := config.ValidateWithoutREST(); err == nil {
+		t.Fatalf("expected auto_revert to need the REST API")
+	}
+
+	var mu sync.Mutex
+	reverts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /a/changes/1234/revert":
+			mu.Lock()
+			reverts++
+			mu.Unlock()
+			// Slow enough for the other failed build to come along while the revert is created.
+			time.Sleep(50 * time.Millisecond)
+			io.WriteString(w, ")]}'\n{\"id\": \"p~main~I5\", \"project\": \"p\", \"branch\": \"main\", \"change_id\": \"I5\", \"_number\": 1240}")
+		case "GET /a/changes/1240":
+			http.Error(w, "not found", http.StatusNotFound)
+		default:
+			io.WriteString(w, ")]}'\n{}")
+		}
+	}))
+	defer server.Close()
+	state.Config = config
+	state.REST = NewGerritREST(server.URL, "buildkite", "secret")
+	state.ReviewTransport = ReviewOverREST
+
+	// Two failed builds blame the same change at once.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state.proposeRevert("p", MergedChange{Number: 1234, Patchset: 1, Subject: "Broke it"}, "It broke the build.")
+		}()
+	}
+	wg.Wait()
+
+	if reverts != 1 {
+		t.Fatalf("expected one revert but got %d", reverts)
+	}
+	if revert, ok := state.GetRevert(1234); !ok || revert != 1240 {
+		t.Fatalf("expected revert 1240 but got %d %v", revert, ok)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+// Building all the open changes sharing a topic together, across projects.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+// Returns the other open changes sharing a topic with the change in the event, or nil if the change isn't built as part of a topic.
+func (s *State) topicChanges(eventInfo EventInfo) ([]QueryChange, error) {
+	if eventInfo.Change.Topic == "" || !s.projectConfig(eventInfo.Change.Project).TopicBuilds {
+		return nil, nil
+	}
+
+	topic, err := gerritQueryPhrase(eventInfo.Change.Topic)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := s.query("status:open topic:"+topic, "--current-patch-set")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []QueryChange
+	var users []string
+	for _, change := range changes {
+		if change.Number == eventInfo.Change.Number || change.CurrentPatchSet == nil {
+			continue
+		}
+		// Everything in the topic runs in the same build, so every uploader needs to be trusted.
+		if users == nil {
+			users = s.listUsers()
+		}
+		if uploader := change.CurrentPatchSet.Uploader.Username; !slices.Contains(users, uploader) {
+			return nil, fmt.Errorf("change %d in topic %s was uploaded by %s who is not authorized to trigger builds", change.Number, eventInfo.Change.Topic, uploader)
+		}
+		result = append(result, change)
+	}
+
+	slices.SortFunc(result, func(a, b QueryChange) int {
+		if c := strings.Compare(a.Project, b.Project); c != 0 {
+			return c
+		}
+		return a.Number - b.Number
+	})
+	return result, nil
+}
+
+// A change built as part of a topic, as published in the build meta-data.
+type TopicMember struct {
+	Project  string `json:"project"`
+	Number   int    `json:"number"`
+	Patchset int    `json:"patchset"`
+	Ref      string `json:"ref"`
+	Revision string `json:"revision"`
+}
+
+// Returns every change in a topic build, starting with the one which triggered it.
+func topicMembers(change *Change, patchSet *PatchSet, others []QueryChange) []TopicMember {
+	members := []TopicMember{{
+		Project:  change.Project,
+		Number:   change.Number,
+		Patchset: patchSet.Number,
+		Ref:      patchSet.Ref,
+		Revision: patchSet.Revision,
+	}}
+	for _, other := range others {
+		members = append(members, TopicMember{
+			Project:  other.Project,
+			Number:   other.Number,
+			Patchset: other.CurrentPatchSet.Number,
+			Ref:      other.CurrentPatchSet.Ref,
+			Revision: other.CurrentPatchSet.Revision,
+		})
+	}
+	return members
+}
+
+// Returns the environment and meta-data describing a topic build.
+// The env lists are space separated and in the same order, so entry i of each describes the same change.
+func topicBuildInfo(topic string, members []TopicMember) (map[string]string, map[string]string) {
+	var projects, numbers, refs []string
+	for _, member := range members {
+		projects = append(projects, member.Project)
+		numbers = append(numbers, fmt.Sprintf("%d", member.Number))
+		refs = append(refs, member.Ref)
+	}
+	env := map[string]string{
+		"GERRIT_TOPIC":          topic,
+		"GERRIT_TOPIC_PROJECTS": strings.Join(projects, " "),
+		"GERRIT_TOPIC_CHANGES":  strings.Join(numbers, " "),
+		"GERRIT_TOPIC_REFS":     strings.Join(refs, " "),
+	}
+
+	data, err := json.Marshal(members)
+	if err != nil {
+		log.Fatalf("json encode failed: %s", err)
+	}
+	metaData := map[string]string{
+		"gerrit-topic":         topic,
+		"gerrit-topic-changes": string(data),
+	}
+	return env, metaData
+}
+
+// Handles a topic-changed event by rebuilding the change with its new topic, or on its own if it left the topic.
+func (s *State) handleTopicChanged(eventInfo EventInfo, client *buildkite.Client) {
+	if !s.watchesProject(eventInfo.Project) || eventInfo.Change == nil {
+		return
+	}
+	if !s.projectConfig(eventInfo.Project).TopicBuilds {
+		return
+	}
+
+	// The event doesn't say which patchset is current.
+	changes, err := s.query(fmt.Sprintf("change:%d", eventInfo.Change.Number), "--current-patch-set")
+	if err != nil || len(changes) != 1 || changes[0].CurrentPatchSet == nil {
+		log.Printf("Failed to find the current patchset of %d: %v", eventInfo.Change.Number, err)
+		return
+	}
+	if !changes[0].Open {
+		return
+	}
+	patchSet := *changes[0].CurrentPatchSet
+
+	if reason := s.skipReason(eventInfo.Change); reason != "" {
+		log.Printf("Not building %d,%d, the change is %s", eventInfo.Change.Number, patchSet.Number, reason)
+		return
+	}
+
+	eventInfo.PatchSet = &patchSet
+	eventInfo.Author = nil
+	eventInfo.Uploader = &patchSet.Uploader
+	if !s.authorizedUser(eventInfo) {
+		return
+	}
+
+	log.Printf("Topic of %d changed from '%s' to '%s', rebuilding", eventInfo.Change.Number, eventInfo.OldTopic, eventInfo.Change.Topic)
+	s.handleEvent(eventInfo, client)
+}
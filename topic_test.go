@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestTopicBuildInfo(t *testing.T) {
+	change := &Change{Project: "frc971", Number: 10, Topic: "t"}
+	patchSet := &PatchSet{Number: 2, Ref: "refs/changes/10/10/2", Revision: "a"}
+	others := []QueryChange{
+		{Change: Change{Project: "aos", Number: 11}, CurrentPatchSet: &PatchSet{Number: 1, Ref: "refs/changes/11/11/1", Revision: "b"}},
+		{Change: Change{Project: "frc971", Number: 12}, CurrentPatchSet: &PatchSet{Number: 3, Ref: "refs/changes/12/12/3", Revision: "c"}},
+	}
+
+	members := topicMembers(change, patchSet, others)
+	env, metaData := topicBuildInfo("t", members)
+
+	expectedEnv := map[string]string{
+		"GERRIT_TOPIC":          "t",
+		"GERRIT_TOPIC_PROJECTS": "frc971 aos frc971",
+		"GERRIT_TOPIC_CHANGES":  "10 11 12",
+		"GERRIT_TOPIC_REFS":     "refs/changes/10/10/2 refs/changes/11/11/1 refs/changes/12/12/3",
+	}
+	if !reflect.DeepEqual(env, expectedEnv) {
+		t.Fatalf("expected env %v but got %v", expectedEnv, env)
+	}
+
+	var decoded []TopicMember
+	if err := json.Unmarshal([]byte(metaData["gerrit-topic-changes"]), &decoded); err != nil {
+		t.Fatalf("failed to decode meta-data: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, members) || metaData["gerrit-topic"] != "t" {
+		t.Fatalf("unexpected meta-data %v", metaData)
+	}
+}
+
+func TestBuildChanges(t *testing.T) {
+	state := setupTestState(t)
+
+	if others := state.GetBuildChanges("abc-123"); len(others) != 0 {
+		t.Fatalf("expected no other changes but got %v", others)
+	}
+
+	expected := []Commit{
+		{Sha1: "b", ChangeId: "I11", ChangeNumber: 11, Patchset: 1},
+		{Sha1: "c", ChangeId: "I12", ChangeNumber: 12, Patchset: 3},
+	}
+	state.AddBuildChanges("abc-123", expected)
+	if others := state.GetBuildChanges("abc-123"); !reflect.DeepEqual(others, expected) {
+		t.Fatalf("expected %v but got %v", expected, others)
+	}
+}
+
+func TestTopicQuery(t *testing.T) {
+	calls := fakeSSH(t)
+	config, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {"topic_builds": true}}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	state := &State{Project: "frc971", Config: config}
+
+	type testCase struct {
+		topic  string
+		search string
+	}
+
+	testCases := []testCase{
+		{topic: "feature", search: `status:open topic:"feature"`},
+		// Quotes can't close the phrase and add operators.
+		{topic: `x" OR status:open "`, search: `status:open topic:{x" OR status:open "}`},
+		{topic: "it's", search: `status:open topic:"it's"`},
+		// Nothing quotes both.
+		{topic: `{"}`, search: ""},
+	}
+
+	for id, tc := range testCases {
+		_, err := state.topicChanges(EventInfo{Change: &Change{Project: "frc971", Number: 10, Topic: tc.topic}})
+		queries := calls()
+		if tc.search == "" {
+			if err == nil || len(queries) != 0 {
+				t.Fatalf("expected case %d to be rejected but got %v %q", id, err, queries)
+			}
+			continue
+		}
+		if err != nil || len(queries) != 1 || queries[0][len(queries[0])-1] != gerritQuote(tc.search) {
+			t.Fatalf("expected search %q for case %d but got %v %q", tc.search, id, err, queries)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+// CI-* trailers in commit messages which let authors control how their change is built.
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// A "Key: value" line from the trailer block of a commit message.
+type Trailer struct {
+	Key   string
+	Value string
+}
+
+func (t Trailer) String() string {
+	return t.Key + ": " + t.Value
+}
+
+var trailerLine = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9-]*)\s*:\s*(.*)$`)
+
+// Trailers git or gerrit add, which mark a paragraph as a trailer block even when it holds other lines.
+var knownTrailers = []string{"signed-off-by", "change-id"}
+
+// Returns the trailers of a commit message, following git interpret-trailers.  Trailers are in the last paragraph,
+// which can't be the subject.  The paragraph is only a trailer block if all its lines are trailers, or at least a quarter
+// of them are and one was added by git or gerrit.  Lines starting with whitespace continue the previous trailer.
+func parseTrailers(message string) []Trailer {
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(message, "\r\n", "\n"), "\n \t"), "\n")
+
+	start := -1
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.TrimSpace(lines[i]) == "" {
+			start = i + 1
+			break
+		}
+	}
+	if start <= 0 {
+		return nil
+	}
+
+	var result []Trailer
+	total, known := 0, false
+	for _, line := range lines[start:] {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(result) > 0 {
+			last := &result[len(result)-1]
+			last.Value = strings.TrimSpace(last.Value + " " + strings.TrimSpace(line))
+			continue
+		}
+		total++
+		match := trailerLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		if slices.Contains(knownTrailers, strings.ToLower(match[1])) {
+			known = true
+		}
+		result = append(result, Trailer{Key: match[1], Value: strings.TrimSpace(match[2])})
+	}
+
+	if len(result) == total || (known && len(result)*4 >= total) {
+		return result
+	}
+	return nil
+}
+
+// What the CI-* trailers of a commit message ask for.
+type CIRequest struct {
+	// Set if CI-Skip asks not to build the change, along with the reason given.
+	Skip   bool
+	Reason string
+	// Pipelines to build in instead of verify_pipelines.
+	Pipelines []string
+	// Extra environment for the builds.
+	Env map[string]string
+	// The CI-* trailers, to echo back to the author.
+	Trailers []Trailer
+}
+
+// Returns what the CI-* trailers of a commit message ask for, or an error if they ask for something the project doesn't allow.
+func (s *State) ciRequest(change *Change) (CIRequest, error) {
+	var request CIRequest
+	config := s.projectConfig(change.Project).CITrailers
+	if config == nil {
+		return request, nil
+	}
+	for _, trailer := range parseTrailers(change.CommitMessage) {
+		key := strings.ToLower(trailer.Key)
+		if !strings.HasPrefix(key, "ci-") {
+			continue
+		}
+		request.Trailers = append(request.Trailers, trailer)
+
+		switch key {
+		case "ci-skip":
+			if !config.Skip {
+				return request, fmt.Errorf("%s: skipping CI isn't allowed in %s", trailer.Key, change.Project)
+			}
+			request.Skip = true
+			request.Reason = trailer.Value
+		case "ci-pipelines":
+			// Picking pipelines can drop required ones, so it has to be allowed explicitly.
+			allowed := config.Pipelines
+			if len(allowed) == 0 {
+				return request, fmt.Errorf("%s: choosing pipelines isn't allowed in %s", trailer.Key, change.Project)
+			}
+			for _, pipeline := range strings.FieldsFunc(trailer.Value, func(r rune) bool { return r == ',' || r == ' ' }) {
+				if !slices.Contains(allowed, pipeline) {
+					return request, fmt.Errorf("%s: pipeline %q isn't one of %s", trailer.Key, pipeline, strings.Join(allowed, ", "))
+				}
+				if !slices.Contains(request.Pipelines, pipeline) {
+					request.Pipelines = append(request.Pipelines, pipeline)
+				}
+			}
+			if len(request.Pipelines) == 0 {
+				return request, fmt.Errorf("%s: no pipelines listed", trailer.Key)
+			}
+		case "ci-env":
+			k, v, ok := strings.Cut(trailer.Value, "=")
+			if !ok {
+				return request, fmt.Errorf("%s: %q isn't KEY=VALUE", trailer.Key, trailer.Value)
+			}
+			if !slices.Contains(config.Env, k) {
+				return request, fmt.Errorf("%s: %s can't be set, allowed are %s", trailer.Key, k, strings.Join(config.Env, ", "))
+			}
+			if request.Env == nil {
+				request.Env = map[string]string{}
+			}
+			request.Env[k] = v
+		default:
+			return request, fmt.Errorf("unknown trailer %s, expected CI-Skip, CI-Pipelines or CI-Env", trailer.Key)
+		}
+	}
+	return request, nil
+}
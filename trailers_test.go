@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTrailers(t *testing.T) {
+	type testCase struct {
+		message     string
+		expectation []Trailer
+	}
+
+	testCases := []testCase{
+		{
+			message: "Add a feature\n\nLonger description.\n\nCI-Pipelines: linux, docs\nChange-Id: I123\n",
+			expectation: []Trailer{
+				{Key: "CI-Pipelines", Value: "linux, docs"},
+				{Key: "Change-Id", Value: "I123"},
+			},
+		},
+		// The subject is never a trailer
+		{
+			message:     "CI-Skip: yes\n",
+			expectation: nil,
+		},
+		// Trailers only count in the last paragraph
+		{
+			message:     "Add a feature\n\nCI-Skip: yes\n\nMore description.\n",
+			expectation: nil,
+		},
+		// Mixed paragraphs need a trailer added by git or gerrit
+		{
+			message:     "Add a feature\n\nSee below\nCI-Skip: yes\n",
+			expectation: nil,
+		},
+		{
+			message: "Add a feature\n\nSee below\nCI-Skip: yes\nChange-Id: I123\n",
+			expectation: []Trailer{
+				{Key: "CI-Skip", Value: "yes"},
+				{Key: "Change-Id", Value: "I123"},
+			},
+		},
+		// Continuation lines and CRLF
+		{
+			message: "Add a feature\r\n\r\nCI-Skip: only touches\r\n  comments\r\nChange-Id: I123\r\n",
+			expectation: []Trailer{
+				{Key: "CI-Skip", Value: "only touches comments"},
+				{Key: "Change-Id", Value: "I123"},
+			},
+		},
+	}
+
+	for id, tc := range testCases {
+		trailers := parseTrailers(tc.message)
+		if len(trailers) != len(tc.expectation) {
+			t.Fatalf("expected %v for case %d but got %v", tc.expectation, id, trailers)
+		}
+		for i := range trailers {
+			if trailers[i] != tc.expectation[i] {
+				t.Fatalf("expected %v for case %d but got %v", tc.expectation, id, trailers)
+			}
+		}
+	}
+}
+
+func TestCIRequest(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `{"projects": {
+		"frc971": {
+			"verify_pipelines": ["linux", "embedded", "docs"],
+			"ci_trailers": {"skip": true, "env": ["SANITIZER"], "pipelines": ["linux", "asan", "docs"]}
+		},
+		"strict": {"ci_trailers": {"pipelines": ["linux"]}},
+		"skips": {"ci_trailers": {"skip": true}},
+		"other": {}
+	}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	state := &State{Project: "frc971", Config: config}
+
+	request := func(project string, trailers ...string) (CIRequest, error) {
+		return state.ciRequest(&Change{
+			Project:       project,
+			CommitMessage: "Add a feature\n\n" + strings.Join(append(trailers, "Change-Id: I123"), "\n") + "\n",
+		})
+	}
+
+	ci, err := request("frc971", "CI-Pipelines: linux,asan", "ci-env: SANITIZER=address", "CI-Pipelines: linux docs")
+	if err != nil {
+		t.Fatalf("failed to parse trailers: %s", err)
+	}
+	if strings.Join(ci.Pipelines, ",") != "linux,asan,docs" || ci.Env["SANITIZER"] != "address" || ci.Skip || len(ci.Trailers) != 3 {
+		t.Fatalf("unexpected request %#v", ci)
+	}
+
+	ci, err = request("frc971", "CI-Skip: typo fix")
+	if err != nil || !ci.Skip || ci.Reason != "typo fix" {
+		t.Fatalf("unexpected request %#v %v", ci, err)
+	}
+
+	for id, trailers := range [][]string{
+		{"CI-Pipelines: release"},
+		{"CI-Pipelines: ,"},
+		{"CI-Env: PATH=/tmp"},
+		{"CI-Env: SANITIZER"},
+		{"CI-Skipp: yes"},
+	} {
+		if _, err := request("frc971", trailers...); err == nil {
+			t.Fatalf("expected case %d to be rejected", id)
+		}
+	}
+
+	if _, err := request("strict", "CI-Skip: yes"); err == nil {
+		t.Fatalf("expected CI-Skip to be rejected where it isn't allowed")
+	}
+	if _, err := request("strict", "CI-Pipelines: embedded"); err == nil {
+		t.Fatalf("expected CI-Pipelines to be limited to the configured pipelines")
+	}
+	if _, err := request("skips", "CI-Pipelines: ci"); err == nil {
+		t.Fatalf("expected CI-Pipelines to be rejected without configured pipelines")
+	}
+	if ci, err := request("other", "CI-Skip: yes"); err != nil || ci.Skip || len(ci.Trailers) != 0 {
+		t.Fatalf("expected trailers to be ignored where they aren't enabled but got %#v %v", ci, err)
+	}
+
+	message := state.projectConfig("frc971").renderMessage(MessageStarted, MessageTemplateData{
+		Trailers: []Trailer{{Key: "CI-Env", Value: "SANITIZER=address"}},
+		Build:    MessageBuild{URL: "https://buildkite.com/b/1"},
+	})
+	if message != "Build Started: https://buildkite.com/b/1\n\nAs asked for by the commit message:\nCI-Env: SANITIZER=address" {
+		t.Fatalf("unexpected message %q", message)
+	}
+}
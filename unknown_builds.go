@@ -0,0 +1,142 @@
+package main
+
+// Webhooks for builds we haven't recorded, because Buildkite sent them before answering the create or we lost track of the build.
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Meta-data keys holding the verification run and attempt a change build was created for, so a build we lost track of
+// is recovered into its run rather than counted as a newer attempt.
+const (
+	BuildRunKey     = "gerrit-buildkite-run"
+	BuildAttemptKey = "gerrit-buildkite-attempt"
+)
+
+// How long the webhook of an unknown build is held waiting for the build to be recorded, and how often it looks again.
+var (
+	unknownBuildTimeout       = 30 * time.Second
+	unknownBuildRetryInterval = time.Second
+)
+
+// Returns true if we recorded a build, as a change, gate, branch or bisect build.
+func (s *State) buildKnown(id string) bool {
+	if _, ok := s.GetCommit(id); ok {
+		return true
+	}
+	if _, ok := s.GetGateItemForBuild(id); ok {
+		return true
+	}
+	if _, ok := s.GetBranchBuild(id); ok {
+		return true
+	}
+	_, _, ok := s.GetBisectBuild(id)
+	return ok
+}
+
+// Holds the webhook of an unknown build until the build is recorded, then falls back to asking Buildkite which change
+// it built.  Returns false if the build still can't be matched to anything we started.
+func (s *State) awaitUnknownBuild(webhook BuildkiteWebhook) bool {
+	log.Printf("Holding %s of unknown build %s until it is recorded", webhook.Event, webhook.Build.ID)
+	for deadline := time.Now().Add(unknownBuildTimeout); time.Now().Before(deadline); {
+		time.Sleep(unknownBuildRetryInterval)
+		s.recordPendingBuild(webhook.Build)
+		if s.buildKnown(webhook.Build.ID) {
+			log.Printf("Build %s was recorded while its %s was held", webhook.Build.ID, webhook.Event)
+			return true
+		}
+	}
+	return s.correlateFromBuildkite(webhook)
+}
+
+// API URL of a build, eg; https://api.buildkite.com/v2/organizations/<org>/pipelines/<pipeline>/builds/<number>
+var buildAPIURL = regexp.MustCompile(`/organizations/[^/]+/pipelines/([^/]+)/builds/\d+$`)
+
+// Returns the Buildkite pipeline slug of the build in a webhook, from the pipeline or the API URL of the build.
+func webhookPipeline(webhook BuildkiteWebhook) string {
+	if webhook.Pipeline.Slug != "" {
+		return webhook.Pipeline.Slug
+	}
+	if match := buildAPIURL.FindStringSubmatch(webhook.Build.URL); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// Fetches an unknown build from Buildkite and records it as a build of the change in its gerrit environment or
+// meta-data.  Gate builds are only tracked in their queue, and branch and bisect builds don't name a change, so only
+// change builds can be recovered.  Returns false if the build isn't a change build of a project we watch.
+func (s *State) correlateFromBuildkite(webhook BuildkiteWebhook) bool {
+	pipeline := webhookPipeline(webhook)
+	if s.Buildkite == nil || pipeline == "" || webhook.Build.Number == 0 {
+		return false
+	}
+	build, err := getBuildJobs(s.Buildkite, s.BuildkiteOrganization, pipeline, webhook.Build.Number)
+	if err != nil {
+		log.Printf("Failed to fetch unknown build %s #%d: %v", pipeline, webhook.Build.Number, err)
+		return false
+	}
+
+	gerrit := func(name string) string {
+		if value, ok := build.Env[name]; ok {
+			return value
+		}
+		return build.MetaData[metaDataKey(name)]
+	}
+	if gerrit("GERRIT_GATE") != "" {
+		return false
+	}
+	changeNumber, err := strconv.Atoi(gerrit("GERRIT_CHANGE_NUMBER"))
+	if err != nil {
+		return false
+	}
+	patchset, err := strconv.Atoi(gerrit("GERRIT_PATCH_NUMBER"))
+	if err != nil {
+		return false
+	}
+	project := gerrit("GERRIT_PROJECT")
+	if !s.watchesProject(project) {
+		return false
+	}
+
+	// Builds from before runs and attempts were recorded in the meta-data are the next attempt, outside of any run.
+	run, _ := strconv.ParseInt(build.MetaData[BuildRunKey], 10, 64)
+	attempt, _ := strconv.Atoi(build.MetaData[BuildAttemptKey])
+
+	unlock := s.changes.Lock(changeNumber)
+	defer unlock()
+	if _, ok := s.GetCommit(webhook.Build.ID); ok {
+		// Recorded while we were asking.
+		return true
+	}
+	if r, ok := s.GetVerificationRun(run); run != 0 && (!ok || r.ChangeNumber != changeNumber || r.Patchset != patchset) {
+		log.Printf("Build %s names run %d, which isn't a run of %d,%d", webhook.Build.ID, run, changeNumber, patchset)
+		run = 0
+	}
+	if change, _ := s.recordedChange(Commit{ChangeNumber: changeNumber}); change.Subject == "" {
+		// We lost track of the change too, so remember what the build says about it for the messages.
+		s.RecordChange(&Change{
+			Number:  changeNumber,
+			Branch:  gerrit("GERRIT_BRANCH"),
+			Subject: gerrit("GERRIT_CHANGE_SUBJECT"),
+			URL:     gerrit("GERRIT_CHANGE_URL"),
+			Owner:   User{Name: gerrit("GERRIT_CHANGE_OWNER_NAME"), Email: gerrit("GERRIT_CHANGE_OWNER_EMAIL")},
+		})
+	}
+	s.AddCommit(webhook.Build.ID, Commit{
+		Sha1:         gerrit("GERRIT_PATCHSET_REVISION"),
+		ChangeId:     gerrit("GERRIT_CHANGE_ID"),
+		ChangeNumber: changeNumber,
+		Patchset:     patchset,
+		Project:      project,
+		Pipeline:     pipeline,
+		Number:       webhook.Build.Number,
+		Run:          run,
+		Attempt:      attempt,
+	})
+	log.Printf("Matched unknown build %s to %d,%d, run %d, attempt %d from its gerrit environment", webhook.Build.ID, changeNumber, patchset, run, attempt)
+	return true
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookPipeline(t *testing.T) {
+	type testCase struct {
+		webhook     BuildkiteWebhook
+		expectation string
+	}
+
+	testCases := []testCase{
+		{webhook: BuildkiteWebhook{Pipeline: BuildkitePipeline{Slug: "ci"}}, expectation: "ci"},
+		{webhook: BuildkiteWebhook{Build: Build{URL: "https://api.buildkite.com/v2/organizations/org/pipelines/docs/builds/12"}}, expectation: "docs"},
+		{webhook: BuildkiteWebhook{Build: Build{URL: "https://buildkite.com/org/docs/builds/12"}}, expectation: ""},
+	}
+
+	for id, tc := range testCases {
+		if pipeline := webhookPipeline(tc.webhook); pipeline != tc.expectation {
+			t.Fatalf("expected %q for case %d but got %q", tc.expectation, id, pipeline)
+		}
+	}
+}
+
+func TestUnknownBuilds(t *testing.T) {
+	state := setupTestState(t)
+	state.DB.SetMaxOpenConns(1)
+
+	timeout, interval := unknownBuildTimeout, unknownBuildRetryInterval
+	unknownBuildTimeout, unknownBuildRetryInterval = 100*time.Millisecond, 10*time.Millisecond
+	defer func() {
+		unknownBuildTimeout, unknownBuildRetryInterval = timeout, interval
+	}()
+
+	builds := map[int]string{
+		1: `"env": {"GERRIT_PROJECT": "frc971", "GERRIT_CHANGE_NUMBER": "1234", "GERRIT_PATCH_NUMBER": "2", "GERRIT_PATCHSET_REVISION": "abc", "GERRIT_CHANGE_SUBJECT": "Fix the arm"}`,
+		2: `"meta_data": {"gerrit-project": "frc971", "gerrit-change-number": "1235", "gerrit-patch-number": "1"}`,
+		3: `"env": {"GERRIT_GATE": "true", "GERRIT_PROJECT": "frc971", "GERRIT_CHANGE_NUMBER": "1234", "GERRIT_PATCH_NUMBER": "2"}`,
+		4: `"env": {"GERRIT_PROJECT": "other", "GERRIT_CHANGE_NUMBER": "1234", "GERRIT_PATCH_NUMBER": "2"}`,
+		5: `"env": {"GERRIT_PROJECT": "frc971", "GERRIT_REF": "refs/heads/main"}`,
+	}
+	reviewed := make(chan ReviewInput, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/a/changes/") {
+			var input ReviewInput
+			json.NewDecoder(r.Body).Decode(&input)
+			reviewed <- input
+			return
+		}
+		var number int
+		if _, err := fmt.Sscanf(r.URL.Path, "/v2/organizations/org/pipelines/ci/builds/%d", &number); err != nil || builds[number] == "" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"number": %d, %s}`, number, builds[number])
+	}))
+	defer server.Close()
+
+	state.Project = "frc971"
+	state.Token = "secret"
+	state.Buildkite = testBuildkiteClient(t, server)
+	state.BuildkiteOrganization = "org"
+	state.REST = NewGerritREST(server.URL, "buildkite", "secret")
+	state.ReviewTransport = ReviewOverREST
+	webhook := func(id string, number int) BuildkiteWebhook {
+		return BuildkiteWebhook{Event: "build.finished", Build: Build{ID: id, Number: number, State: "failed"}, Pipeline: BuildkitePipeline{Slug: "ci"}}
+	}
+
+	// Recorded late, while the webhook is held.
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		state.AddCommit("late", Commit{ChangeNumber: 1000, Patchset: 1, Pipeline: "ci", Number: 9})
+	}()
+	if !state.awaitUnknownBuild(webhook("late", 9)) {
+		t.Fatalf("expected the late build to be found")
+	}
+
+	type testCase struct {
+		id           string
+		number       int
+		expectation  bool
+		changeNumber int
+		patchset     int
+	}
+
+	testCases := []testCase{
+		{id: "env", number: 1, expectation: true, changeNumber: 1234, patchset: 2},
+		{id: "meta-data", number: 2, expectation: true, changeNumber: 1235, patchset: 1},
+		{id: "gate", number: 3, expectation: false},
+		{id: "other-project", number: 4, expectation: false},
+		{id: "branch", number: 5, expectation: false},
+		{id: "missing", number: 6, expectation: false},
+	}
+
+	for id, tc := range testCases {
+		if ok := state.awaitUnknownBuild(webhook(tc.id, tc.number)); ok != tc.expectation {
+			t.Fatalf("expected %v for case %d but got %v", tc.expectation, id, ok)
+		}
+		commit, ok := state.GetCommit(tc.id)
+		if ok != tc.expectation || commit.ChangeNumber != tc.changeNumber || commit.Patchset != tc.patchset {
+			t.Fatalf("unexpected commit %#v %v for case %d", commit, ok, id)
+		}
+		if ok && (commit.Project != "frc971" || commit.Pipeline != "ci" || commit.Number != tc.number) {
+			t.Fatalf("unexpected commit %#v for case %d", commit, id)
+		}
+	}
+	if commit, _ := state.GetCommit("env"); commit.Sha1 != "abc" {
+		t.Fatalf("expected the revision from the environment but got %#v", commit)
+	}
+	if change, _ := state.recordedChange(Commit{ChangeNumber: 1234}); change.Subject != "Fix the arm" {
+		t.Fatalf("expected the subject from the environment but got %#v", change)
+	}
+
+	// A duplicate of a recorded build rejoins its run as the same attempt, rather than becoming a newer attempt outside of it.
+	run := state.AddVerificationRun("frc971", 1237, 1, []string{"ci"})
+	state.AddCommit("recorded", Commit{ChangeNumber: 1237, Patchset: 1, Project: "frc971", Pipeline: "ci", Run: run, Attempt: 1})
+	builds[8] = fmt.Sprintf(`"meta_data": {"gerrit-project": "frc971", "gerrit-change-number": "1237", "gerrit-patch-number": "1", "gerrit-buildkite-run": "%d", "gerrit-buildkite-attempt": "1"}`, run)
+	// Runs of other patchsets are ignored.
+	builds[9] = fmt.Sprintf(`"meta_data": {"gerrit-project": "frc971", "gerrit-change-number": "1237", "gerrit-patch-number": "2", "gerrit-buildkite-run": "%d", "gerrit-buildkite-attempt": "1"}`, run)
+	for _, number := range []int{8, 9} {
+		if !state.awaitUnknownBuild(webhook(fmt.Sprintf("duplicate-%d", number), number)) {
+			t.Fatalf("expected build %d to be recovered", number)
+		}
+	}
+	if commit, _ := state.GetCommit("duplicate-8"); commit.Run != run || commit.Attempt != 1 {
+		t.Fatalf("expected the duplicate to rejoin run %d as attempt 1 but got %#v", run, commit)
+	}
+	if latest := state.LatestAttempt(1237, 1, "ci"); latest != 1 {
+		t.Fatalf("expected the duplicate not to be a newer attempt but got %d", latest)
+	}
+	if commit, _ := state.GetCommit("duplicate-9"); commit.Run != 0 || commit.Attempt != 1 {
+		t.Fatalf("expected the build outside its run to be recovered without it but got %#v", commit)
+	}
+
+	// A finished webhook for a build we never recorded still votes.
+	builds[7] = `"env": {"GERRIT_PROJECT": "frc971", "GERRIT_CHANGE_NUMBER": "1236", "GERRIT_PATCH_NUMBER": "3"}`
+	body, _ := json.Marshal(webhook("lost", 7))
+	request := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	request.Header.Set("X-Buildkite-Token", "secret")
+	state.handle(httptest.NewRecorder(), request)
+	select {
+	case review := <-reviewed:
+		if review.Labels["Verified"] != -1 {
+			t.Fatalf("unexpected review %#v", review)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the result of the lost build wasn't posted")
+	}
+}
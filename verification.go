@@ -0,0 +1,282 @@
+package main
+
+// Verification runs, building a patchset in several pipelines and combining their results into one vote.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The builds of a patchset started together.
+type VerificationRun struct {
+	ID           int64
+	Project      string
+	ChangeNumber int
+	Patchset     int
+	// Pipelines the patchset is built in.
+	Pipelines []string
+}
+
+// The latest build of a pipeline in a run.
+type RunBuild struct {
+	ID string
+	// Buildkite build number, 0 for results carried forward from an earlier patchset.
+	Number int
+	// Final state of the build, empty while it runs.
+	State  string
+	WebURL string
+}
+
+// Returns the pipelines patchsets of a project are built in.
+func (s *State) verifyPipelines(project string) []string {
+	if pipelines := s.projectConfig(project).VerifyPipelines; len(pipelines) > 0 {
+		return pipelines
+	}
+	return []string{s.BuildkiteProject}
+}
+
+// Records a new run and returns its id.
+func (s *State) AddVerificationRun(project string, changeNumber int, patchset int, pipelines []string) int64 {
+	data, err := json.Marshal(pipelines)
+	if err != nil {
+		log.Fatalf("json encode failed: %s", err)
+	}
+	result, err := s.DB.Exec("insert into verification_runs (project, changenumber, patchset, pipelines) values (?, ?, ?, ?)",
+		project, changeNumber, patchset, string(data))
+	if err != nil {
+		log.Fatalf("Failed to exec: %s", err)
+	}
+	id, _ := result.LastInsertId()
+	return id
+}
+
+func (s *State) GetVerificationRun(id int64) (VerificationRun, bool) {
+	var run VerificationRun
+	var pipelines string
+	err := s.DB.QueryRow("select id, project, changenumber, patchset, pipelines from verification_runs where id = ?", id).Scan(
+		&run.ID, &run.Project, &run.ChangeNumber, &run.Patchset, &pipelines)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Fatalf("Failed to query: '%v'", err)
+		}
+		return run, false
+	}
+	if err := json.Unmarshal([]byte(pipelines), &run.Pipelines); err != nil {
+		log.Fatalf("json decode failed: %s", err)
+	}
+	return run, true
+}
+
+// Returns the most recent run of a patchset.
+func (s *State) GetLatestPatchsetRun(changeNumber int, patchset int) (VerificationRun, bool) {
+	var id int64
+	err := s.DB.QueryRow("select id from verification_runs where changenumber = ? and patchset = ? order by id desc limit 1", changeNumber, patchset).Scan(&id)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Fatalf("Failed to query: '%v'", err)
+		}
+		return VerificationRun{}, false
+	}
+	return s.GetVerificationRun(id)
+}
+
+// Adds a pipeline to a run, if it isn't already built in it.
+func (s *State) AddRunPipeline(run VerificationRun, pipeline string) {
+	if slices.Contains(run.Pipelines, pipeline) {
+		return
+	}
+	data, err := json.Marshal(append(run.Pipelines, pipeline))
+	if err != nil {
+		log.Fatalf("json encode failed: %s", err)
+	}
+	if _, err := s.DB.Exec("update verification_runs set pipelines = ? where id = ?", string(data), run.ID); err != nil {
+		log.Fatalf("Failed to exec: %s", err)
+	}
+}
+
+// Returns the latest build of each pipeline in a run, keyed by pipeline.  Rebuilds replace the build they rebuilt.
+func (s *State) GetRunBuilds(id int64) map[string]RunBuild {
+	rows, err := s.DB.Query("select id, coalesce(number, 0), pipeline, coalesce(state, ''), coalesce(weburl, '') from buildkite where run = ? order by rowid", id)
+	if err != nil {
+		log.Fatalf("Failed to query: '%v'", err)
+	}
+	defer rows.Close()
+
+	result := map[string]RunBuild{}
+	for rows.Next() {
+		var pipeline string
+		var build RunBuild
+		if err := rows.Scan(&build.ID, &build.Number, &pipeline, &build.State, &build.WebURL); err != nil {
+			log.Fatalf("Failed to scan: '%v'", err)
+		}
+		if build.State == BuildCanceling {
+			build.State = "canceled"
+		}
+		result[pipeline] = build
+	}
+	return result
+}
+
+// Returns the combined votes of a run.  A label votes the lowest value of its pipelines once they have all finished
+// with a vote, or as soon as any of them votes negative.  A pipeline which finished without voting, because it was
+// canceled or lost to the infrastructure, keeps the label from voting anything else.
+func (s *State) runVotes(run VerificationRun, builds map[string]RunBuild) map[string]string {
+	type labelVote struct {
+		value    string
+		lowest   int
+		negative bool
+		finished bool
+		unvoted  bool
+	}
+	votes := map[string]*labelVote{}
+	var labels []string
+	for _, pipeline := range run.Pipelines {
+		config := s.pipelineConfig(run.Project, pipeline)
+		if !*config.Voting {
+			continue
+		}
+		vote, ok := votes[config.Label]
+		if !ok {
+			vote = &labelVote{finished: true}
+			votes[config.Label] = vote
+			labels = append(labels, config.Label)
+		}
+
+		build, ok := builds[pipeline]
+		if !ok || build.State == "" {
+			vote.finished = false
+			continue
+		}
+		value, ok := config.vote(build.State)[config.Label]
+		if !ok {
+			vote.unvoted = true
+			continue
+		}
+		v, _ := strconv.Atoi(value)
+		if vote.value == "" || v < vote.lowest {
+			vote.value = value
+			vote.lowest = v
+		}
+		if v < 0 {
+			vote.negative = true
+		}
+	}
+
+	result := map[string]string{}
+	for _, label := range labels {
+		vote := votes[label]
+		if vote.value != "" && ((vote.finished && !vote.unvoted) || vote.negative) {
+			result[label] = vote.value
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// Returns true if every voting pipeline of a run has finished with a result which says something about the change.
+func (s *State) runCompleted(run VerificationRun, builds map[string]RunBuild) bool {
+	for _, pipeline := range run.Pipelines {
+		if !*s.pipelineConfig(run.Project, pipeline).Voting {
+			continue
+		}
+		build, ok := builds[pipeline]
+		if !ok || build.State == "" || !buildCompleted(build.State) {
+			return false
+		}
+	}
+	return true
+}
+
+// Describes the state of each pipeline in a run, one per line.
+func (s *State) runStatus(run VerificationRun, builds map[string]RunBuild) string {
+	var lines []string
+	for _, pipeline := range run.Pipelines {
+		name := pipeline
+		if !*s.pipelineConfig(run.Project, pipeline).Voting {
+			name += " (non-voting)"
+		}
+		build, ok := builds[pipeline]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf(" * %s: not started", name))
+		case build.State == "":
+			lines = append(lines, fmt.Sprintf(" * %s: running", name))
+		default:
+			lines = append(lines, fmt.Sprintf(" * %s: %s", name, strings.TrimSpace(build.State+" "+build.WebURL)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Posts the result of a finished change build, and the combined vote of its run, on its change and the rest of its topic.
+// Builds which only failed because agents were lost are retried first, and don't vote if they keep failing.
+// Only the most recent attempt at building the patchset in the pipeline votes, older attempts are informational.
+func (s *State) reportBuildFinished(commit Commit, others []Commit, build Build) {
+	pipeline := s.commitPipelineConfig(commit)
+	jobs := s.finishedBuildJobs(commit, build)
+	state := buildVoteState(build)
+	latest := s.LatestAttempt(commit.ChangeNumber, commit.Patchset, commit.Pipeline)
+	superseded := commit.Attempt < latest
+	if state == "failed" && !superseded && jobs != nil && jobs.InfrastructureFailure() {
+		if commit.Retries < *pipeline.InfraRetries && s.retryInfraFailure(commit, others, build, jobs) {
+			return
+		}
+		state = InfraFailed
+	}
+	s.SetBuildResult(build.ID, state, build.WebURL)
+
+	event := finishedMessageEvent(state)
+	data := MessageTemplateData{Build: s.finishedMessageBuild(commit, build, jobs)}
+	data.Change, data.PatchSet = s.recordedChange(commit)
+
+	message := s.commitProjectConfig(commit).renderMessage(event, data)
+	labels := pipeline.vote(state)
+	status := ""
+	run, ok := s.GetVerificationRun(commit.Run)
+	if ok {
+		builds := s.GetRunBuilds(run.ID)
+		// Results of non-voting builds are only informational, even when the rest of the run has finished.
+		if *pipeline.Voting {
+			labels = s.runVotes(run, builds)
+		}
+		if len(run.Pipelines) > 1 {
+			status = "\n\n" + s.runStatus(run, builds)
+		}
+	}
+	if superseded {
+		// The newer attempt reset the label when it started, and decides it.
+		log.Printf("Build %s is attempt %d of %d,%d in %s, but attempt %d is newer", build.ID, commit.Attempt, commit.ChangeNumber, commit.Patchset, commit.Pipeline, latest)
+		labels = nil
+		status += fmt.Sprintf("\n\nNot voting, attempt %d at building this patchset is newer.", latest)
+	}
+
+	review := Review{
+		Message: message + status,
+		Labels:  labels,
+	}
+	if !*pipeline.Voting || superseded {
+		review.Notify = "NONE"
+	}
+	s.review(commit.ChangeNumber, commit.Patchset, review)
+	// Topic builds report the combined result on every change in the topic.
+	for _, other := range others {
+		data.Change, data.PatchSet = s.recordedChange(other)
+		data.TopicChange = commit.ChangeNumber
+		otherLabels := labels
+		if len(run.Pipelines) <= 1 && !superseded {
+			otherLabels = s.pipelineConfig(other.Project, commit.Pipeline).vote(state)
+		}
+		s.review(other.ChangeNumber, other.Patchset, Review{
+			Message: s.commitProjectConfig(other).renderMessage(event, data) + status,
+			Notify:  review.Notify,
+			Labels:  otherLabels,
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRunVotes(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {
+		"verify_pipelines": ["linux", "embedded", "docs"],
+		"pipelines": {"docs": {"label": "Docs-Verified"}}
+	}}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	state := &State{Project: "frc971", Config: config}
+	run := VerificationRun{Project: "frc971", Pipelines: state.verifyPipelines("frc971")}
+
+	type testCase struct {
+		builds      map[string]RunBuild
+		expectation map[string]string
+	}
+
+	testCases := []testCase{
+		// Nothing finished yet
+		{
+			builds:      map[string]RunBuild{"linux": {}, "embedded": {}, "docs": {}},
+			expectation: map[string]string{},
+		},
+		// Waiting for embedded before voting +1, docs votes on its own
+		{
+			builds:      map[string]RunBuild{"linux": {State: "passed"}, "embedded": {}, "docs": {State: "passed"}},
+			expectation: map[string]string{"Docs-Verified": "+1"},
+		},
+		// Failures vote straight away
+		{
+			builds:      map[string]RunBuild{"linux": {}, "embedded": {State: "failed"}},
+			expectation: map[string]string{"Verified": "-1"},
+		},
+		{
+			builds:      map[string]RunBuild{"linux": {State: "passed"}, "embedded": {State: "passed"}, "docs": {State: "failed"}},
+			expectation: map[string]string{"Verified": "+1", "Docs-Verified": "-1"},
+		},
+		{
+			builds:      map[string]RunBuild{"linux": {State: "failed"}, "embedded": {State: "passed"}, "docs": {State: "passed"}},
+			expectation: map[string]string{"Verified": "-1", "Docs-Verified": "+1"},
+		},
+		// Pipelines which finished without a vote keep the label from going positive
+		{
+			builds:      map[string]RunBuild{"linux": {State: "passed"}, "embedded": {State: "canceled"}, "docs": {State: "infra_failed"}},
+			expectation: map[string]string{},
+		},
+		{
+			builds:      map[string]RunBuild{"linux": {State: "failed"}, "embedded": {State: "canceled"}},
+			expectation: map[string]string{"Verified": "-1"},
+		},
+	}
+
+	for id, tc := range testCases {
+		labels := state.runVotes(run, tc.builds)
+		if len(labels) != len(tc.expectation) {
+			t.Fatalf("expected %v for case %d but got %v", tc.expectation, id, labels)
+		}
+		for label, value := range tc.expectation {
+			if labels[label] != value {
+				t.Fatalf("expected %v for case %d but got %v", tc.expectation, id, labels)
+			}
+		}
+	}
+
+	if pipelines := (&State{BuildkiteProject: "ci"}).verifyPipelines("other"); len(pipelines) != 1 || pipelines[0] != "ci" {
+		t.Fatalf("expected unconfigured projects to build in --buildkite_project but got %v", pipelines)
+	}
+}
+
+func TestVerificationRunBuilds(t *testing.T) {
+	state := setupTestState(t)
+
+	run := state.AddVerificationRun("p", 1234, 2, []string{"linux", "docs"})
+	other := state.AddVerificationRun("p", 1234, 2, []string{"linux"})
+	state.AddCommit("build-1", Commit{ChangeNumber: 1234, Patchset: 2, Pipeline: "linux", Run: run})
+	state.AddCommit("build-2", Commit{ChangeNumber: 1234, Patchset: 2, Pipeline: "docs", Run: run})
+	state.AddCommit("build-3", Commit{ChangeNumber: 1234, Patchset: 2, Pipeline: "linux", Run: other})
+	state.SetBuildResult("build-1", "failed", "https://buildkite.com/1")
+
+	builds := state.GetRunBuilds(run)
+	if len(builds) != 2 || builds["linux"].State != "failed" || builds["docs"].State != "" {
+		t.Fatalf("unexpected builds %#v", builds)
+	}
+
+	// A rebuild replaces the failed build.
+	state.AddCommit("build-4", Commit{ChangeNumber: 1234, Patchset: 2, Pipeline: "linux", Run: run})
+	state.SetBuildResult("build-4", "passed", "https://buildkite.com/4")
+	if builds := state.GetRunBuilds(run); builds["linux"].State != "passed" || builds["linux"].WebURL != "https://buildkite.com/4" {
+		t.Fatalf("unexpected builds %#v", builds)
+	}
+
+	loaded, ok := state.GetVerificationRun(run)
+	if !ok || loaded.ChangeNumber != 1234 || loaded.Patchset != 2 || len(loaded.Pipelines) != 2 || loaded.Pipelines[1] != "docs" {
+		t.Fatalf("unexpected run %#v %v", loaded, ok)
+	}
+	if commit, ok := state.GetCommit("build-2"); !ok || commit.Run != run {
+		t.Fatalf("unexpected commit %#v %v", commit, ok)
+	}
+	if _, ok := state.GetVerificationRun(0); ok {
+		t.Fatalf("expected no run for builds outside of runs")
+	}
+}
+
+func TestStaleBuildResults(t *testing.T) {
+	state := setupTestState(t)
+
+	var reviews []ReviewInput
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input ReviewInput
+		json.NewDecoder(r.Body).Decode(&input)
+		reviews = append(reviews, input)
+	}))
+	defer server.Close()
+	state.Project = "frc971"
+	state.REST = NewGerritREST(server.URL, "buildkite", "secret")
+	state.ReviewTransport = ReviewOverREST
+
+	for _, id := range []string{"first", "retest", "docs", "rebuild"} {
+		pipeline := "ci"
+		if id == "docs" {
+			pipeline = "docs"
+		}
+		state.AddCommit(id, Commit{ChangeNumber: 1234, Patchset: 2, Project: "frc971", Pipeline: pipeline})
+	}
+	state.AddCommit("other", Commit{ChangeNumber: 1234, Patchset: 3, Project: "frc971", Pipeline: "ci"})
+
+	type testCase struct {
+		id          string
+		state       string
+		attempt     int
+		expectation map[string]int
+		message     string
+	}
+
+	// Builds finish in the opposite order to how they were started.
+	testCases := []testCase{
+		{id: "other", state: "passed", attempt: 1, expectation: map[string]int{"Verified": 1}, message: "Build Succeeded: https://buildkite.com/other"},
+		{id: "rebuild", state: "passed", attempt: 3, expectation: map[string]int{"Verified": 1}, message: "Build Succeeded: https://buildkite.com/rebuild"},
+		// Attempts are counted per pipeline.
+		{id: "docs", state: "failed", attempt: 1, expectation: map[string]int{"Verified": -1}, message: "Build Failed: https://buildkite.com/docs"},
+		{id: "retest", state: "failed", attempt: 2, expectation: nil,
+			message: "Build Failed: https://buildkite.com/retest\n\nNot voting, attempt 3 at building this patchset is newer."},
+		{id: "first", state: "passed", attempt: 1, expectation: nil,
+			message: "Build Succeeded: https://buildkite.com/first\n\nNot voting, attempt 3 at building this patchset is newer."},
+	}
+
+	for id, tc := range testCases {
+		commit, ok := state.GetCommit(tc.id)
+		if !ok || commit.Attempt != tc.attempt {
+			t.Fatalf("expected attempt %d for case %d but got %#v", tc.attempt, id, commit)
+		}
+		reviews = nil
+		state.reportBuildFinished(commit, nil, Build{ID: tc.id, State: tc.state, WebURL: fmt.Sprintf("https://buildkite.com/%s", tc.id)})
+		if len(reviews) != 1 || reviews[0].Message != tc.message {
+			t.Fatalf("expected message %q for case %d but got %#v", tc.message, id, reviews)
+		}
+		if len(reviews[0].Labels) != len(tc.expectation) {
+			t.Fatalf("expected %v for case %d but got %v", tc.expectation, id, reviews[0].Labels)
+		}
+		for label, value := range tc.expectation {
+			if reviews[0].Labels[label] != value {
+				t.Fatalf("expected %v for case %d but got %v", tc.expectation, id, reviews[0].Labels)
+			}
+		}
+		if tc.expectation == nil && reviews[0].Notify != "NONE" {
+			t.Fatalf("expected stale results not to notify for case %d", id)
+		}
+	}
+
+	// The result of a stale build is still recorded.
+	if commit, _ := state.GetCommit("retest"); commit.State != "failed" {
+		t.Fatalf("expected the stale result to be recorded but got %q", commit.State)
+	}
+}
+
+func TestRetryFailedRun(t *testing.T) {
+	state := setupTestState(t)
+
+	config, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {"verify_pipelines": ["linux", "docs"]}}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+
+	var retried []string
+	var reviews []ReviewInput
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/a/changes/") {
+			var input ReviewInput
+			json.NewDecoder(r.Body).Decode(&input)
+			reviews = append(reviews, input)
+			return
+		}
+		// /v2/organizations/org/pipelines/<pipeline>/builds/<number>[/jobs/<job>/retry]
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) < 8 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if r.Method == "PUT" {
+			retried = append(retried, parts[5]+"/"+parts[9])
+			return
+		}
+		fmt.Fprintf(w, `{"number": %s, "web_url": "https://buildkite.com/%s/%s", "jobs": [{"id": "j%s", "type": "script", "name": "test", "state": "failed"}]}`,
+			parts[7], parts[5], parts[7], parts[7])
+	}))
+	defer server.Close()
+
+	state.Project = "frc971"
+	state.Config = config
+	state.BuildkiteOrganization = "org"
+	state.REST = NewGerritREST(server.URL, "buildkite", "secret")
+	state.ReviewTransport = ReviewOverREST
+
+	old := state.AddVerificationRun("frc971", 1234, 2, []string{"linux", "docs"})
+	state.AddCommit("old-linux", Commit{ChangeNumber: 1234, Patchset: 2, Project: "frc971", Pipeline: "linux", Number: 1, Run: old})
+	latest := state.AddVerificationRun("frc971", 1234, 2, []string{"linux", "docs"})
+	state.AddCommit("linux", Commit{ChangeNumber: 1234, Patchset: 2, Project: "frc971", Pipeline: "linux", Number: 2, Run: latest})
+	state.AddCommit("docs", Commit{ChangeNumber: 1234, Patchset: 2, Project: "frc971", Pipeline: "docs", Number: 3, Run: latest})
+	state.SetBuildResult("old-linux", "failed", "https://buildkite.com/linux/1")
+	state.SetBuildResult("linux", "failed", "https://buildkite.com/linux/2")
+	state.SetBuildResult("docs", "failed", "https://buildkite.com/docs/3")
+
+	state.retryFailedJobs(EventInfo{Change: &Change{Project: "frc971", Number: 1234}, PatchSet: &PatchSet{Number: 2}}, testBuildkiteClient(t, server))
+
+	if len(retried) != 2 || retried[0] != "linux/j2" || retried[1] != "docs/j3" {
+		t.Fatalf("expected the failed jobs of the latest run to be retried but got %v", retried)
+	}
+	expected := "Retrying 1 failed jobs (test): https://buildkite.com/linux/2\nRetrying 1 failed jobs (test): https://buildkite.com/docs/3"
+	if len(reviews) != 1 || reviews[0].Message != expected || reviews[0].Labels["Verified"] != 0 || len(reviews[0].Labels) != 1 {
+		t.Fatalf("unexpected reviews %#v", reviews)
+	}
+
+	// The retried builds are running again, so they can be canceled.
+	if running := state.GetRunningBuilds(1234); len(running) != 2 || running["linux"].Number != 2 || running["docs"].Number != 3 {
+		t.Fatalf("expected the retried builds to be running but got %v", running)
+	}
+
+	// The vote waits for both retried builds.
+	for _, id := range []string{"linux", "docs"} {
+		commit, _ := state.GetCommit(id)
+		reviews = nil
+		state.reportBuildFinished(commit, nil, Build{ID: id, State: "passed", WebURL: "https://buildkite.com/" + id})
+		if len(reviews) != 1 {
+			t.Fatalf("expected one review for %s but got %#v", id, reviews)
+		}
+		if id == "linux" && len(reviews[0].Labels) != 0 {
+			t.Fatalf("expected no vote while docs runs but got %v", reviews[0].Labels)
+		}
+	}
+	if reviews[0].Labels["Verified"] != 1 {
+		t.Fatalf("expected +1 once both builds passed but got %v", reviews[0].Labels)
+	}
+}
+
+func TestRetestPipelineRun(t *testing.T) {
+	state := setupTestState(t)
+
+	config, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {"verify_pipelines": ["linux", "docs"]}}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+
+	var reviews []ReviewInput
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/a/changes/") {
+			var input ReviewInput
+			json.NewDecoder(r.Body).Decode(&input)
+			reviews = append(reviews, input)
+			return
+		}
+		fmt.Fprint(w, `{"id": "docs-retest", "number": 4, "web_url": "https://buildkite.com/docs/4"}`)
+	}))
+	defer server.Close()
+
+	state.Project = "frc971"
+	state.Config = config
+	state.BuildkiteOrganization = "org"
+	state.REST = NewGerritREST(server.URL, "buildkite", "secret")
+	state.ReviewTransport = ReviewOverREST
+
+	run := state.AddVerificationRun("frc971", 1234, 2, []string{"linux", "docs"})
+	state.AddCommit("linux", Commit{ChangeNumber: 1234, Patchset: 2, Project: "frc971", Pipeline: "linux", Number: 2, Run: run})
+	state.AddCommit("docs", Commit{ChangeNumber: 1234, Patchset: 2, Project: "frc971", Pipeline: "docs", Number: 3, Run: run})
+	state.SetBuildResult("linux", "failed", "https://buildkite.com/linux/2")
+	state.SetBuildResult("docs", "failed", "https://buildkite.com/docs/3")
+
+	// "retest docs" builds docs again in the same run.
+	state.triggerBuild(EventInfo{
+		Project:  "frc971",
+		Change:   &Change{ID: "I1234", Project: "frc971", Number: 1234},
+		PatchSet: &PatchSet{Number: 2, Revision: "cafe"},
+		Author:   &User{Name: "Austin", Email: "austin@example.com", Username: "austin"},
+	}, testBuildkiteClient(t, server), BuildOptions{Pipeline: "docs", Requested: true})
+
+	commit, ok := state.GetCommit("docs-retest")
+	if !ok || commit.Run != run || commit.Attempt != 2 {
+		t.Fatalf("expected the retest to be part of run %d but got %#v", run, commit)
+	}
+
+	// Docs passing doesn't make up for linux failing.
+	reviews = nil
+	state.reportBuildFinished(commit, nil, Build{ID: "docs-retest", State: "passed", WebURL: "https://buildkite.com/docs/4"})
+	if len(reviews) != 1 || reviews[0].Labels["Verified"] > 0 {
+		t.Fatalf("expected the failed linux build to keep the vote from passing but got %#v", reviews)
+	}
+	if !strings.Contains(reviews[0].Message, " * linux: failed https://buildkite.com/linux/2\n * docs: passed https://buildkite.com/docs/4") {
+		t.Fatalf("expected the run's status in the message but got %q", reviews[0].Message)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+// Mapping the final state of builds to label votes.
+
+import (
+	"log"
+	"sync"
+)
+
+// Final build states which can vote.
+var buildStates = []string{"passed", "failed", "canceled", "skipped", "not_run", "blocked", InfraFailed}
+
+// State recorded for builds which failed because agents were lost, once they have been retried infra_retries times.
+const InfraFailed = "infra_failed"
+
+// Vote value which leaves the label alone.
+const NoVote = "none"
+
+// Returns the state a finished build votes with.
+func buildVoteState(build Build) string {
+	switch {
+	case build.Blocked:
+		return "blocked"
+	case build.State == "canceling":
+		return "canceled"
+	}
+	return build.State
+}
+
+// Returns the label vote for a build which finished in state, or nil to leave the label alone.
+func (p *PipelineConfig) vote(state string) map[string]string {
+	if !*p.Voting {
+		return nil
+	}
+	value, ok := p.Votes[state]
+	if !ok {
+		// Anything unexpected counts as a failure.
+		value = p.Votes["failed"]
+	}
+	if value == NoVote {
+		return nil
+	}
+	return map[string]string{p.Label: value}
+}
+
+// Returns the labels to reset while a build in the pipeline runs.
+func (p *PipelineConfig) resetLabels() map[string]string {
+	if !*p.Voting {
+		return nil
+	}
+	return map[string]string{p.Label: "0"}
+}
+
+// Returns the vote configuration of a pipeline in a project.
+func (s *State) pipelineConfig(project string, pipeline string) *PipelineConfig {
+	if project == "" {
+		// Builds recorded before projects were tracked are from --project.
+		project = s.Project
+	}
+	if pipeline == "" {
+		// Builds recorded before pipelines were tracked ran in --buildkite_project.
+		pipeline = s.BuildkiteProject
+	}
+	if config, ok := s.projectConfig(project).Pipelines[pipeline]; ok {
+		return config
+	}
+	return defaultPipelineConfig()
+}
+
+// The vote configuration of pipelines which aren't configured, built once and shared.
+var defaultPipelineConfig = sync.OnceValue(func() *PipelineConfig {
+	config := &PipelineConfig{}
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid default pipeline configuration: %v", err)
+	}
+	return config
+})
+
+// Returns the vote configuration for a recorded build.
+func (s *State) commitPipelineConfig(commit Commit) *PipelineConfig {
+	return s.pipelineConfig(commit.Project, commit.Pipeline)
+}
+
+// Returns true if a build in state ran to completion, so its result says something about the change.
+func buildCompleted(state string) bool {
+	switch state {
+	case "canceled", BuildCanceling, "skipped", "not_run", InfraFailed:
+		return false
+	}
+	return true
+}
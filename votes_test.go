@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPipelineVotes(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {"pipelines": {
+		"ci": {"label": "CI-Verified", "votes": {"canceled": "none", "skipped": "0"}},
+		"lint": {"label": "Code-Style", "votes": {"failed": "-2"}}
+	}}}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	state := &State{Project: "frc971", BuildkiteProject: "ci", Config: config}
+
+	type testCase struct {
+		pipeline    string
+		build       Build
+		expectation map[string]string
+	}
+
+	testCases := []testCase{
+		{pipeline: "ci", build: Build{State: "passed"}, expectation: map[string]string{"CI-Verified": "+1"}},
+		{pipeline: "ci", build: Build{State: "failed"}, expectation: map[string]string{"CI-Verified": "-1"}},
+		{pipeline: "ci", build: Build{State: "canceled"}, expectation: nil},
+		{pipeline: "ci", build: Build{State: "canceling"}, expectation: nil},
+		{pipeline: "ci", build: Build{State: "skipped"}, expectation: map[string]string{"CI-Verified": "0"}},
+		{pipeline: "ci", build: Build{State: "passed", Blocked: true}, expectation: map[string]string{"CI-Verified": "-1"}},
+		// Builds recorded without a pipeline ran in --buildkite_project.
+		{pipeline: "", build: Build{State: "passed"}, expectation: map[string]string{"CI-Verified": "+1"}},
+		{pipeline: "lint", build: Build{State: "failed"}, expectation: map[string]string{"Code-Style": "-2"}},
+		// Unexpected states count as failures.
+		{pipeline: "lint", build: Build{State: "exploded"}, expectation: map[string]string{"Code-Style": "-2"}},
+		{pipeline: "docs", build: Build{State: "failed"}, expectation: map[string]string{"Verified": "-1"}},
+		// Builds which didn't run to completion leave the label alone.
+		{pipeline: "docs", build: Build{State: "not_run"}, expectation: nil},
+		{pipeline: "docs", build: Build{State: "canceled"}, expectation: nil},
+	}
+
+	for id, tc := range testCases {
+		labels := state.commitPipelineConfig(Commit{Pipeline: tc.pipeline}).vote(buildVoteState(tc.build))
+		if len(labels) != len(tc.expectation) {
+			t.Fatalf("expected %v for case %d but got %v", tc.expectation, id, labels)
+		}
+		for label, value := range tc.expectation {
+			if labels[label] != value {
+				t.Fatalf("expected %v for case %d but got %v", tc.expectation, id, labels)
+			}
+		}
+	}
+
+	if labels := state.pipelineConfig("frc971", "lint").resetLabels(); labels["Code-Style"] != "0" || len(labels) != 1 {
+		t.Fatalf("unexpected reset labels %v", labels)
+	}
+}
+
+func TestInvalidPipelineVotes(t *testing.T) {
+	for id, contents := range []string{
+		`{"projects": {"frc971": {"pipelines": {"ci": {"votes": {"running": "+1"}}}}}}`,
+		`{"projects": {"frc971": {"pipelines": {"ci": {"votes": {"passed": "yes"}}}}}}`,
+		`{"projects": {"frc971": {"pipelines": {"ci": null}}}}`,
+		`{"projects": {"frc971": {"pipelines": {"ci": {"infra_retries": -1}}}}}`,
+	} {
+		if _, err := LoadConfig(writeConfig(t, contents)); err == nil {
+			t.Fatalf("expected case %d to be rejected", id)
+		}
+	}
+}
+
+func TestNonVotingPipelines(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `{"projects": {"frc971": {
+		"verify_pipelines": ["linux", "sanitizer"],
+		"pipelines": {"sanitizer": {"voting": false}}
+	}}}`))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	state := &State{Project: "frc971", Config: config}
+
+	sanitizer := state.pipelineConfig("frc971", "sanitizer")
+	if labels := sanitizer.vote("failed"); labels != nil {
+		t.Fatalf("expected non-voting pipelines not to vote but got %v", labels)
+	}
+	if labels := sanitizer.resetLabels(); labels != nil {
+		t.Fatalf("expected non-voting pipelines not to reset labels but got %v", labels)
+	}
+	if !*state.pipelineConfig("frc971", "linux").Voting {
+		t.Fatalf("expected pipelines to vote by default")
+	}
+
+	run := VerificationRun{Project: "frc971", Pipelines: state.verifyPipelines("frc971")}
+	builds := map[string]RunBuild{"linux": {State: "passed"}, "sanitizer": {State: "failed"}}
+	if labels := state.runVotes(run, builds); len(labels) != 1 || labels["Verified"] != "+1" {
+		t.Fatalf("expected the sanitizer failure to be ignored but got %v", labels)
+	}
+	if labels := state.runVotes(run, map[string]RunBuild{"linux": {State: "passed"}}); labels["Verified"] != "+1" {
+		t.Fatalf("expected not to wait for the sanitizer but got %v", labels)
+	}
+	if status := state.runStatus(run, builds); status != " * linux: passed\n * sanitizer (non-voting): failed" {
+		t.Fatalf("unexpected status %q", status)
+	}
+
+	message := state.projectConfig("frc971").renderMessage(MessageFailed, MessageTemplateData{
+		Build: MessageBuild{URL: "https://buildkite.com/b/1", Pipeline: "sanitizer", NonVoting: true},
+	})
+	if message != "Build Failed in non-voting pipeline sanitizer: https://buildkite.com/b/1" {
+		t.Fatalf("unexpected message %q", message)
+	}
+}